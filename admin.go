@@ -0,0 +1,548 @@
+// countries.io
+// Copyright (C) 2019 Allen B
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program. If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// The token admins send in the Authorization header. Empty if /admin is disabled.
+var adminToken string
+
+// How long the admin API waits for a game thread to answer
+const adminTimeout = time.Second
+
+// Type adminRequest is something an admin asks a game thread to do
+type adminRequest struct {
+	Action  string // info, end or kick
+	Country int    // for kick
+	Reply   chan gameStatus
+}
+
+// Type gameStatus is what a game thread tells admins about its game
+type gameStatus struct {
+	Turn   int   `json:"turn"`
+	Paused bool  `json:"paused"`
+	Losers []int `json:"losers"`
+
+	// Time spent handling ticks, in ms
+	LastTick float64 `json:"last_tick"`
+	MeanTick float64 `json:"mean_tick"`
+	MaxTick  float64 `json:"max_tick"`
+}
+
+// Type tickTiming keeps track of how long a game thread takes to handle its ticks
+type tickTiming struct {
+	Last  time.Duration
+	Max   time.Duration
+	Total time.Duration
+	Count int
+}
+
+func (t *tickTiming) Add(d time.Duration) {
+	t.Last = d
+	t.Total += d
+	t.Count++
+	if d > t.Max {
+		t.Max = d
+	}
+}
+
+func (g *Game) status(pause *pauseState, timing *tickTiming) gameStatus {
+	s := gameStatus{
+		Turn:     g.Turn,
+		Paused:   pause.Paused,
+		Losers:   make([]int, 0, len(g.Losers)),
+		LastTick: timing.Last.Seconds() * 1000,
+		MaxTick:  timing.Max.Seconds() * 1000,
+	}
+	if timing.Count > 0 {
+		s.MeanTick = timing.Total.Seconds() * 1000 / float64(timing.Count)
+	}
+	for loser := range g.Losers {
+		s.Losers = append(s.Losers, loser)
+	}
+	sort.Ints(s.Losers)
+	return s
+}
+
+// Sends a request to a game thread and waits for the answer
+func (thread gameThread) ask(action string, country int) (gameStatus, error) {
+	request := adminRequest{Action: action, Country: country, Reply: make(chan gameStatus, 1)}
+	select {
+	case thread.Admin <- request:
+	case <-time.After(adminTimeout):
+		return gameStatus{}, errors.New("the game hasn't started")
+	}
+	select {
+	case status := <-request.Reply:
+		return status, nil
+	case <-time.After(adminTimeout):
+		return gameStatus{}, errors.New("the game didn't answer")
+	}
+}
+
+// Type banList is the players who can't join rooms or games.
+// If Path isn't empty the list is kept in that file.
+type banList struct {
+	Names map[string]bool `json:"names"`
+	IPs   map[string]bool `json:"ips"`
+
+	Path string `json:"-"`
+	sync.Mutex
+}
+
+// The banned players
+var bans = &banList{Names: make(map[string]bool), IPs: make(map[string]bool)}
+
+// Function openBans loads the ban list from a file, which doesn't have to exist yet
+func openBans(path string) (*banList, error) {
+	b := &banList{Names: make(map[string]bool), IPs: make(map[string]bool), Path: path}
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return b, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(data, b); err != nil {
+		return nil, err
+	}
+	if b.Names == nil {
+		b.Names = make(map[string]bool)
+	}
+	if b.IPs == nil {
+		b.IPs = make(map[string]bool)
+	}
+	return b, nil
+}
+
+// Method Banned returns whether a name or IP address is banned
+func (b *banList) Banned(name string, ip string) bool {
+	b.Lock()
+	defer b.Unlock()
+	return b.Names[name] || b.IPs[ip]
+}
+
+// Method Set bans or unbans a name and an IP address. Either can be empty.
+func (b *banList) Set(name string, ip string, banned bool) error {
+	b.Lock()
+	defer b.Unlock()
+	for _, entry := range []struct {
+		set   map[string]bool
+		value string
+	}{{b.Names, name}, {b.IPs, ip}} {
+		if entry.value == "" {
+			continue
+		}
+		if banned {
+			entry.set[entry.value] = true
+		} else {
+			delete(entry.set, entry.value)
+		}
+	}
+	if b.Path == "" {
+		return nil
+	}
+	data, err := json.Marshal(b)
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(b.Path, data)
+}
+
+// Proxies whose X-Forwarded-For header is believed, set by -trusted-proxies
+var trustedProxies []*net.IPNet
+
+// Function parseProxies parses a comma-separated list of IP addresses and CIDR ranges
+func parseProxies(list string) ([]*net.IPNet, error) {
+	out := make([]*net.IPNet, 0)
+	for _, item := range strings.Split(list, ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+		if !strings.Contains(item, "/") {
+			if ip := net.ParseIP(item); ip != nil && ip.To4() != nil {
+				item += "/32"
+			} else {
+				item += "/128"
+			}
+		}
+		_, network, err := net.ParseCIDR(item)
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, network)
+	}
+	return out, nil
+}
+
+func isTrustedProxy(ip string) bool {
+	parsed := net.ParseIP(ip)
+	if parsed == nil {
+		return false
+	}
+	for _, network := range trustedProxies {
+		if network.Contains(parsed) {
+			return true
+		}
+	}
+	return false
+}
+
+// Function clientIP returns the IP address a request comes from. Behind a trusted
+// proxy that's the last address in X-Forwarded-For that isn't another trusted proxy.
+// Nothing before an entry that isn't an IP address is believed.
+func clientIP(r *http.Request) string {
+	ip, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		ip = r.RemoteAddr
+	}
+	forwarded := strings.Split(strings.Join(r.Header.Values("X-Forwarded-For"), ","), ",")
+	for i := len(forwarded) - 1; i >= 0 && isTrustedProxy(ip); i-- {
+		hop := strings.TrimSpace(forwarded[i])
+		if hop == "" {
+			continue
+		}
+		parsed := net.ParseIP(hop)
+		if parsed == nil {
+			break
+		}
+		// The same address is always written the same way, so bans match it
+		ip = parsed.String()
+	}
+	return ip
+}
+
+// The IP address each websocket came from, worked out when it connected
+var connIPs = struct {
+	Map map[*websocket.Conn]string
+	sync.Mutex
+}{Map: make(map[*websocket.Conn]string)}
+
+// Remembers the IP address of a new websocket
+func setConnIP(conn *websocket.Conn, r *http.Request) {
+	connIPs.Lock()
+	connIPs.Map[conn] = clientIP(r)
+	connIPs.Unlock()
+}
+
+// Forgets the IP address of a websocket that went away
+func forgetConnIP(conn *websocket.Conn) {
+	connIPs.Lock()
+	delete(connIPs.Map, conn)
+	connIPs.Unlock()
+}
+
+// Returns the IP address a websocket comes from
+func connIP(conn *websocket.Conn) string {
+	connIPs.Lock()
+	ip, ok := connIPs.Map[conn]
+	connIPs.Unlock()
+	if ok {
+		return ip
+	}
+	host, _, err := net.SplitHostPort(conn.RemoteAddr().String())
+	if err != nil {
+		return conn.RemoteAddr().String()
+	}
+	return host
+}
+
+// Function kick disconnects the players with a name or IP address from rooms and games.
+// Players in games are taken out of them. It returns how many connections were closed.
+func kick(name string, ip string) int {
+	matches := func(country string, conn *websocket.Conn) bool {
+		return (name != "" && country == name) || (ip != "" && connIP(conn) == ip)
+	}
+	kicked := 0
+
+	// Writes to a connection hold the lock of its map, since its room or game thread writes to it too
+	roomConns.Lock()
+	roomKicked := make([]*websocket.Conn, 0)
+	for conn, info := range roomConns.Map {
+		if matches(info.Country, conn) {
+			roomKicked = append(roomKicked, conn)
+			conn.WriteMessage(websocket.TextMessage, []byte("error you were kicked"))
+		}
+	}
+	roomConns.Unlock()
+	for _, conn := range roomKicked {
+		handleRoomCommand(conn, websocket.CloseMessage, nil)
+		conn.Close()
+		kicked++
+	}
+
+	gameConns.Lock()
+	gameKicked := make(map[*websocket.Conn]gameConnInfo)
+	for conn, info := range gameConns.Map {
+		country := ""
+		if game, _, ok := getGame(info.Game); ok && info.Index >= 0 {
+			country = game.Countries[info.Index]
+		}
+		if matches(country, conn) {
+			gameKicked[conn] = info
+			conn.WriteMessage(websocket.TextMessage, []byte("error you were kicked"))
+			delete(gameConns.Map, conn)
+			conn.Close()
+		}
+	}
+	gameConns.Unlock()
+	for _, info := range gameKicked {
+		if _, thread, ok := getGame(info.Game); ok && info.Index >= 0 {
+			thread.ask("kick", info.Index)
+		}
+		kicked++
+	}
+	return kicked
+}
+
+// Sends an announcement to everyone connected
+func announce(text string) {
+	message := []byte("announcement " + text)
+	roomConns.Lock()
+	for conn := range roomConns.Map {
+		conn.WriteMessage(websocket.TextMessage, message)
+	}
+	roomConns.Unlock()
+	gameConns.Lock()
+	for conn := range gameConns.Map {
+		conn.WriteMessage(websocket.TextMessage, message)
+	}
+	gameConns.Unlock()
+}
+
+// Type adminPlayer is a player in the admin lists
+type adminPlayer struct {
+	Name      string   `json:"name"`
+	Index     int      `json:"index"`
+	Connected bool     `json:"connected"`
+	IPs       []string `json:"ips"`
+}
+
+func listRooms() []map[string]interface{} {
+	roomConns.Lock()
+	defer roomConns.Unlock()
+
+	players := make(map[string][]adminPlayer)
+	for conn, info := range roomConns.Map {
+		players[info.Room] = append(players[info.Room], adminPlayer{
+			Name: info.Country, Index: -1, Connected: true, IPs: []string{connIP(conn)},
+		})
+	}
+	out := make([]map[string]interface{}, 0)
+	for id, room := range rooms {
+		if len(room.Countries) == 0 {
+			continue
+		}
+		out = append(out, map[string]interface{}{
+			"id":         id,
+			"players":    players[id],
+			"max":        room.Max,
+			"custom":     room.Custom,
+			"host":       room.Host,
+			"start_time": room.StartTime,
+		})
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i]["id"].(string) < out[j]["id"].(string) })
+	return out
+}
+
+func listGames() []map[string]interface{} {
+	type entry struct {
+		id     string
+		game   *Game
+		thread gameThread
+	}
+	entries := make([]entry, 0)
+	games.Lock()
+	for id, thread := range games.Threads {
+		if game, ok := games.Map[id]; ok {
+			entries = append(entries, entry{id, game, thread})
+		}
+	}
+	games.Unlock()
+	sort.Slice(entries, func(i, j int) bool { return entries[i].id < entries[j].id })
+
+	gameConns.Lock()
+	players := make(map[string][]adminPlayer)
+	spectators := make(map[string]int)
+	for _, e := range entries {
+		for index, name := range e.game.Countries {
+			players[e.id] = append(players[e.id], adminPlayer{Name: name, Index: index, IPs: []string{}})
+		}
+	}
+	for conn, info := range gameConns.Map {
+		if info.Index < 0 {
+			spectators[info.Game]++
+			continue
+		}
+		if list, ok := players[info.Game]; ok && info.Index < len(list) {
+			list[info.Index].Connected = true
+			list[info.Index].IPs = append(list[info.Index].IPs, connIP(conn))
+		}
+	}
+	gameConns.Unlock()
+
+	// Games waiting for players don't answer until adminTimeout, so ask them all at once
+	out := make([]map[string]interface{}, len(entries))
+	var wg sync.WaitGroup
+	for i, e := range entries {
+		item := map[string]interface{}{
+			"id":         e.id,
+			"players":    players[e.id],
+			"spectators": spectators[e.id],
+			"width":      e.game.Width,
+			"height":     e.game.Height,
+			"topology":   e.game.Topology.Name(),
+		}
+		out[i] = item
+		wg.Add(1)
+		go func(thread gameThread) {
+			defer wg.Done()
+			if status, err := thread.ask("info", -1); err != nil {
+				item["error"] = err.Error()
+			} else {
+				item["status"] = status
+			}
+		}(e.thread)
+	}
+	wg.Wait()
+	return out
+}
+
+// Checks the Authorization header of an admin request
+func adminAuthorized(r *http.Request) bool {
+	token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+	return adminToken != "" && subtle.ConstantTimeCompare([]byte(token), []byte(adminToken)) == 1
+}
+
+// Serves /api/admin/...
+//
+//	GET  /api/admin/rooms
+//	GET  /api/admin/games
+//	POST /api/admin/games/<id>/end
+//	POST /api/admin/kick      {"name": "", "ip": ""}
+//	GET  /api/admin/bans
+//	POST /api/admin/bans      {"name": "", "ip": "", "banned": true}
+//	POST /api/admin/announce  {"text": ""}
+func handleApiAdmin(w http.ResponseWriter, r *http.Request) {
+	if adminToken == "" {
+		writeJSON(w, http.StatusNotFound, map[string]string{"error": "admin is disabled"})
+		return
+	}
+	if !adminAuthorized(r) {
+		writeJSON(w, http.StatusUnauthorized, map[string]string{"error": "wrong token"})
+		return
+	}
+
+	path := strings.Split(strings.Trim(strings.TrimPrefix(r.URL.Path, "/api/admin"), "/"), "/")
+	route := r.Method + " " + path[0]
+	switch {
+	case route == "GET rooms" && len(path) == 1:
+		writeJSON(w, http.StatusOK, listRooms())
+	case route == "GET games" && len(path) == 1:
+		writeJSON(w, http.StatusOK, listGames())
+	case route == "POST games" && len(path) == 3 && path[2] == "end":
+		_, thread, ok := getGame(path[1])
+		if !ok {
+			writeJSON(w, http.StatusNotFound, map[string]string{"error": "game not found"})
+			return
+		}
+		if _, err := thread.ask("end", -1); err != nil {
+			writeJSON(w, http.StatusConflict, map[string]string{"error": err.Error()})
+			return
+		}
+		logInfo("admin ended " + path[1])
+		writeJSON(w, http.StatusOK, map[string]string{})
+	case route == "POST kick" && len(path) == 1:
+		var body struct {
+			Name string `json:"name"`
+			IP   string `json:"ip"`
+		}
+		if !readAdminBody(w, r, &body) {
+			return
+		}
+		writeJSON(w, http.StatusOK, map[string]int{"kicked": kick(body.Name, body.IP)})
+	case route == "GET bans" && len(path) == 1:
+		bans.Lock()
+		data, err := json.Marshal(bans)
+		bans.Unlock()
+		if err != nil {
+			writeJSON(w, http.StatusInternalServerError, map[string]string{"error": err.Error()})
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(data)
+	case route == "POST bans" && len(path) == 1:
+		var body struct {
+			Name   string `json:"name"`
+			IP     string `json:"ip"`
+			Banned bool   `json:"banned"`
+		}
+		if !readAdminBody(w, r, &body) {
+			return
+		}
+		if err := bans.Set(body.Name, body.IP, body.Banned); err != nil {
+			writeJSON(w, http.StatusInternalServerError, map[string]string{"error": err.Error()})
+			return
+		}
+		kicked := 0
+		if body.Banned {
+			kicked = kick(body.Name, body.IP)
+		}
+		writeJSON(w, http.StatusOK, map[string]int{"kicked": kicked})
+	case route == "POST announce" && len(path) == 1:
+		var body struct {
+			Text string `json:"text"`
+		}
+		if !readAdminBody(w, r, &body) {
+			return
+		}
+		text := strings.Join(strings.Fields(body.Text), " ")
+		if text == "" {
+			writeJSON(w, http.StatusBadRequest, map[string]string{"error": "empty announcement"})
+			return
+		}
+		announce(text)
+		writeJSON(w, http.StatusOK, map[string]string{})
+	default:
+		writeJSON(w, http.StatusNotFound, map[string]string{"error": "not found"})
+	}
+}
+
+// Reads the JSON body of an admin request. Writes an error and returns false if it can't.
+func readAdminBody(w http.ResponseWriter, r *http.Request, v interface{}) bool {
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 1<<16)).Decode(v); err != nil {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": err.Error()})
+		return false
+	}
+	return true
+}
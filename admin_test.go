@@ -0,0 +1,134 @@
+// countries.io
+// Copyright (C) 2019 Allen B
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program. If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"net"
+	"net/http/httptest"
+	"reflect"
+	"strconv"
+	"testing"
+)
+
+// Admins list games while others start and end, which used to be able to crash the server
+func TestListGamesWhileGamesEnd(t *testing.T) {
+	admin := make(chan adminRequest)
+	go func() {
+		for request := range admin {
+			request.Reply <- gameStatus{}
+		}
+	}()
+	defer close(admin)
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 200; i++ {
+			id := "test" + strconv.Itoa(i)
+			addGame(id, commandTestGame(), gameThread{Admin: admin})
+			removeGame(id)
+		}
+	}()
+	for {
+		select {
+		case <-done:
+			if list := listGames(); len(list) != 0 {
+				t.Errorf("ended games are still listed: %v", list)
+			}
+			return
+		default:
+			listGames()
+		}
+	}
+}
+
+func TestClientIP(t *testing.T) {
+	proxies, err := parseProxies("10.0.0.1, 192.168.0.0/16, fd00::/8")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func(old []*net.IPNet) { trustedProxies = old }(trustedProxies)
+	trustedProxies = proxies
+
+	tests := []struct {
+		name      string
+		remote    string
+		forwarded []string
+		want      string
+	}{
+		{"no proxy", "203.0.113.5:1234", nil, "203.0.113.5"},
+		{"untrusted peer with a spoofed header", "203.0.113.5:1234", []string{"1.2.3.4"}, "203.0.113.5"},
+		{"trusted proxy", "10.0.0.1:1234", []string{"203.0.113.5"}, "203.0.113.5"},
+		{"trusted proxy without the header", "10.0.0.1:1234", nil, "10.0.0.1"},
+		{"chain of trusted proxies", "10.0.0.1:1234", []string{"203.0.113.5, 192.168.1.1, 192.168.7.7"}, "203.0.113.5"},
+		{"chain over several headers", "10.0.0.1:1234", []string{"203.0.113.5", "192.168.1.1"}, "203.0.113.5"},
+		{"client spoofs entries before the real one", "10.0.0.1:1234", []string{"1.2.3.4, 203.0.113.5"}, "203.0.113.5"},
+		{"untrusted hop in the chain", "10.0.0.1:1234", []string{"203.0.113.5, 198.51.100.9, 192.168.1.1"}, "198.51.100.9"},
+		{"empty entries", "10.0.0.1:1234", []string{"203.0.113.5, , "}, "203.0.113.5"},
+		{"malformed entry", "10.0.0.1:1234", []string{"not-an-ip"}, "10.0.0.1"},
+		{"nothing before a malformed entry is believed", "10.0.0.1:1234", []string{"1.2.3.4, garbage"}, "10.0.0.1"},
+		{"entry with a port", "10.0.0.1:1234", []string{"203.0.113.5:80"}, "10.0.0.1"},
+		{"IPv6 client", "10.0.0.1:1234", []string{"2001:db8::1"}, "2001:db8::1"},
+		{"IPv6 client written another way", "10.0.0.1:1234", []string{"2001:DB8:0::1"}, "2001:db8::1"},
+		{"IPv4 in IPv6", "10.0.0.1:1234", []string{"::ffff:203.0.113.5"}, "203.0.113.5"},
+		{"IPv6 proxy", "[fd00::1]:1234", []string{"203.0.113.5"}, "203.0.113.5"},
+		{"untrusted IPv6 peer", "[2001:db8::2]:1234", []string{"203.0.113.5"}, "2001:db8::2"},
+		{"remote address without a port", "10.0.0.1", []string{"203.0.113.5"}, "203.0.113.5"},
+	}
+	for _, test := range tests {
+		r := httptest.NewRequest("GET", "/ws/game", nil)
+		r.RemoteAddr = test.remote
+		for _, header := range test.forwarded {
+			r.Header.Add("X-Forwarded-For", header)
+		}
+		if got := clientIP(r); got != test.want {
+			t.Errorf("%s: got %s, want %s", test.name, got, test.want)
+		}
+	}
+}
+
+func TestParseProxies(t *testing.T) {
+	tests := []struct {
+		list string
+		want []string
+		ok   bool
+	}{
+		{"", []string{}, true},
+		{"10.0.0.1", []string{"10.0.0.1/32"}, true},
+		{" 10.0.0.0/8 ,::1", []string{"10.0.0.0/8", "::1/128"}, true},
+		{"10.0.0.300", nil, false},
+		{"10.0.0.0/33", nil, false},
+		{"proxy.example.com", nil, false},
+	}
+	for _, test := range tests {
+		got, err := parseProxies(test.list)
+		if (err == nil) != test.ok {
+			t.Errorf("%q: error %v", test.list, err)
+			continue
+		}
+		if err != nil {
+			continue
+		}
+		networks := make([]string, 0)
+		for _, network := range got {
+			networks = append(networks, network.String())
+		}
+		if !reflect.DeepEqual(networks, test.want) {
+			t.Errorf("%q: got %v, want %v", test.list, networks, test.want)
+		}
+	}
+}
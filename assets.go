@@ -0,0 +1,116 @@
+// countries.io
+// Copyright (C) 2019 Allen B
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program. If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"embed"
+	"encoding/hex"
+	"io/fs"
+	"net/http"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// The pages, styles, images and sounds, built into the program
+//
+//go:embed *.html *.css *.svg *.wav
+var embeddedAssets embed.FS
+
+// Type asset is a file served to browsers
+type asset struct {
+	Data []byte
+	ETag string
+}
+
+// Type assetStore serves static files. They are read from the embedded copy,
+// or from Dir on every request if Dir isn't empty.
+type assetStore struct {
+	Dir   string
+	files map[string]asset
+}
+
+// The static files of the server
+var assets *assetStore
+
+// Function openAssets loads the embedded files. If dir isn't empty files are
+// read from it instead, so they can be edited without building again.
+func openAssets(dir string) (*assetStore, error) {
+	a := &assetStore{
+		Dir:   dir,
+		files: make(map[string]asset),
+	}
+	entries, err := fs.ReadDir(embeddedAssets, ".")
+	if err != nil {
+		return nil, err
+	}
+	for _, entry := range entries {
+		data, err := embeddedAssets.ReadFile(entry.Name())
+		if err != nil {
+			return nil, err
+		}
+		sum := sha256.Sum256(data)
+		a.files[entry.Name()] = asset{
+			Data: data,
+			ETag: `"` + hex.EncodeToString(sum[:8]) + `"`,
+		}
+	}
+	return a, nil
+}
+
+// Method Names returns the names of the files that aren't pages
+func (a *assetStore) Names() []string {
+	names := make([]string, 0, len(a.files))
+	for name := range a.files {
+		if !strings.HasSuffix(name, ".html") {
+			names = append(names, name)
+		}
+	}
+	return names
+}
+
+// Method Handler returns a handler that serves a file
+func (a *assetStore) Handler(name string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		a.serve(w, r, name)
+	})
+}
+
+func (a *assetStore) serve(w http.ResponseWriter, r *http.Request, name string) {
+	if a.Dir != "" {
+		w.Header().Set("Cache-Control", "no-cache")
+		http.ServeFile(w, r, filepath.Join(a.Dir, name))
+		return
+	}
+
+	file, ok := a.files[name]
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+	// Pages change with the server, so browsers have to check them every time.
+	// Other files can be kept for a while.
+	if strings.HasSuffix(name, ".html") {
+		w.Header().Set("Cache-Control", "no-cache")
+	} else {
+		w.Header().Set("Cache-Control", "public, max-age=3600")
+	}
+	w.Header().Set("ETag", file.ETag)
+	http.ServeContent(w, r, name, time.Time{}, bytes.NewReader(file.Data))
+}
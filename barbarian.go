@@ -0,0 +1,112 @@
+// countries.io
+// Copyright (C) 2019 Allen B
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program. If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+const (
+	// Armies in a new camp and on the land around it
+	campArmy     = 40
+	campLandArmy = 5
+
+	// Camps aren't placed closer than this to a capital
+	campDistance = 6
+
+	// Camps grow by one army every campGrowth turns
+	campGrowth = 5
+
+	// Every raidInterval turns, camps with at least raidMinArmy armies take
+	// the weakest player tile within raidRadius, if it has less than half the camp's armies
+	raidInterval = 100
+	raidMinArmy  = 20
+	raidRadius   = 4
+
+	// What a country gets for taking a camp
+	campRewardGold     = 100
+	campRewardResearch = 500
+)
+
+// Method PlaceCamps puts up to n barbarian camps on empty land away from capitals
+func (g *Game) PlaceCamps(n int) {
+	for tries := 0; n > 0 && tries < 100*n; tries++ {
+		tile := g.random.Intn(len(g.Terrain))
+		if g.Terrain[tile] != TILE_EMPTY || g.TileSpecial(tile) {
+			continue
+		}
+		tooClose := false
+		for _, tileAround := range g.TilesAround(tile, campDistance) {
+			if g.Terrain[tileAround] != TILE_EMPTY || g.Has(tileAround, BUILDING_CAPITAL) {
+				tooClose = true
+				break
+			}
+		}
+		if tooClose {
+			continue
+		}
+
+		g.placeCamp(tile)
+		n--
+	}
+}
+
+// Puts a camp on a tile
+func (g *Game) placeCamp(tile int) {
+	for _, tileAround := range g.TilesAround(tile, 1) {
+		g.setTerrain(tileAround, TILE_BARBARIAN)
+		g.setArmies(tileAround, campLandArmy)
+	}
+	g.setBuilding(tile, BUILDING_CAMP)
+	g.setArmies(tile, campArmy)
+}
+
+// Grows camps and sends out raids
+func (g *Game) updateBarbarians() {
+	for _, camp := range g.buildingTiles(BUILDING_CAMP) {
+		if g.Turn%campGrowth == 0 && g.Turn != 0 {
+			g.setArmies(camp, g.Armies[camp]+1)
+		}
+
+		if g.Turn%raidInterval != 0 || g.Turn == 0 || g.Armies[camp] < raidMinArmy {
+			continue
+		}
+		target := -1
+		for _, tile := range g.TilesAround(camp, raidRadius) {
+			if g.Terrain[tile] < 0 || g.TileSpecial(tile) || g.Armies[tile] >= g.Armies[camp]/2 {
+				continue
+			}
+			if target < 0 || g.Armies[tile] < g.Armies[target] {
+				target = tile
+			}
+		}
+		if target < 0 {
+			continue
+		}
+
+		raid := g.Armies[camp] / 2
+		g.setArmies(camp, g.Armies[camp]-raid)
+		g.setArmies(target, raid-g.Armies[target])
+		country := g.Terrain[target]
+		g.setTerrain(target, TILE_BARBARIAN)
+		g.checkLoss(country)
+	}
+}
+
+// Gives a country the reward for taking a camp
+func (g *Game) captureCamp(countryIndex int, tileIndex int) {
+	g.setBuilding(tileIndex, BUILDING_NONE)
+	g.ConvertAround(tileIndex, 1, countryIndex, TILE_BARBARIAN)
+	g.Gold[countryIndex] += campRewardGold
+	g.ResearchPoints[countryIndex] += campRewardResearch
+}
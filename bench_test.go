@@ -0,0 +1,77 @@
+// countries.io
+// Copyright (C) 2019 Allen B
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program. If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"testing"
+	"time"
+)
+
+// Map sizes BenchmarkNextTurn measures
+var benchmarkSizes = []int{50, 100, 200}
+
+// Function crowdedGame returns a game where every tile is owned, split between
+// the countries by which capital is closest, with a city every 8 tiles
+func crowdedGame(size int, players int) *Game {
+	countries := make([]string, players)
+	for i := range countries {
+		countries[i] = "bot" + strconv.Itoa(i)
+	}
+	g := NewGame(countries, size, size, squareTopology{}, false, 1)
+
+	var fields [][]int
+	var owners []int
+	for _, capital := range g.buildingTiles(BUILDING_CAPITAL) {
+		fields = append(fields, distancesFrom(g.Topology, g.Width, g.Height, capital, nil))
+		owners = append(owners, g.Terrain[capital])
+	}
+	for tile := range g.Terrain {
+		closest := 0
+		for i, field := range fields {
+			if field[tile] < fields[closest][tile] {
+				closest = i
+			}
+		}
+		g.setTerrain(tile, owners[closest])
+		if g.Armies[tile] == 0 {
+			g.setArmies(tile, 1)
+		}
+		if tile/size%8 == 4 && tile%size%8 == 4 && !g.TileSpecial(tile) {
+			g.setBuilding(tile, BUILDING_CITY)
+		}
+	}
+	return g
+}
+
+// Function BenchmarkNextTurn times NextTurn on crowded maps of different sizes. The
+// cost per tile it reports should stay about the same as maps get bigger.
+func BenchmarkNextTurn(b *testing.B) {
+	for _, size := range benchmarkSizes {
+		size := size
+		b.Run(fmt.Sprintf("%dx%d", size, size), func(b *testing.B) {
+			g := crowdedGame(size, 4)
+			b.ResetTimer()
+			start := time.Now()
+			for i := 0; i < b.N; i++ {
+				g.NextTurn()
+			}
+			b.ReportMetric(float64(time.Since(start).Nanoseconds())/float64(b.N*size*size), "ns/tile")
+		})
+	}
+}
@@ -0,0 +1,115 @@
+// countries.io
+// Copyright (C) 2019 Allen B
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program. If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+// Type BuildingType is what is built on a tile
+type BuildingType int
+
+const (
+	BUILDING_NONE BuildingType = iota
+	BUILDING_CITY
+	BUILDING_CAPITAL
+	BUILDING_SCHOOL
+	BUILDING_PORTAL
+	BUILDING_LAUNCHER
+	BUILDING_CAMP
+
+	buildingTypeCount
+)
+
+// Type Building is the building on a tile
+type Building struct {
+	Type  BuildingType
+	Owner int // owner of the tile when it was built
+	Built int // turn it was built
+}
+
+// Type buildingKind is what a type of building does
+type buildingKind struct {
+	// Name of the list of these buildings in update messages
+	Name string
+
+	// The tile is urban land
+	Urban bool
+
+	// Land of the same country this close is suburb, 0 for none
+	SuburbRadius int
+
+	// Armies on the tile are scientists instead of soldiers
+	Scientists bool
+
+	// Gold paid every economyInterval turns
+	Upkeep int
+}
+
+// Everything about each building type. Adding a type here is enough for it
+// to be counted, sent to players and to make urban land and suburbs.
+var buildingKinds = [buildingTypeCount]buildingKind{
+	BUILDING_NONE:     {},
+	BUILDING_CITY:     {Name: "cities", Urban: true, SuburbRadius: 1},
+	BUILDING_CAPITAL:  {Name: "capitals", Urban: true, SuburbRadius: 2},
+	BUILDING_SCHOOL:   {Name: "schools", Scientists: true, Upkeep: upkeepSchool},
+	BUILDING_PORTAL:   {Name: "portals", Upkeep: upkeepPortal},
+	BUILDING_LAUNCHER: {Name: "launchers", Upkeep: upkeepLauncher},
+	BUILDING_CAMP:     {Name: "camps"},
+}
+
+// Method Has returns true if a tile has a type of building
+func (g *Game) Has(tile int, buildingType BuildingType) bool {
+	return g.Buildings[tile].Type == buildingType
+}
+
+// Method kind returns what the building on a tile does
+func (g *Game) kind(tile int) buildingKind {
+	return buildingKinds[g.Buildings[tile].Type]
+}
+
+// Method setBuilding builds on a tile, replacing what was there.
+// BUILDING_NONE removes the building.
+func (g *Game) setBuilding(tile int, buildingType BuildingType) {
+	old := g.Buildings[tile].Type
+	if old == buildingType {
+		return
+	}
+	g.countTile(tile, -1)
+	if buildingType == BUILDING_NONE {
+		g.Buildings[tile] = Building{}
+	} else {
+		g.Buildings[tile] = Building{
+			Type:  buildingType,
+			Owner: g.Terrain[tile],
+			Built: g.Turn,
+		}
+	}
+	g.countTile(tile, 1)
+
+	if buildingKinds[old].Urban || buildingKinds[old].SuburbRadius > 0 ||
+		buildingKinds[buildingType].Urban || buildingKinds[buildingType].SuburbRadius > 0 {
+		g.updateTileTypes(tile)
+	}
+}
+
+// Method buildingTiles returns every tile with a type of building
+func (g *Game) buildingTiles(buildingType BuildingType) []int {
+	out := make([]int, 0)
+	for tile, building := range g.Buildings {
+		if building.Type == buildingType {
+			out = append(out, tile)
+		}
+	}
+	return out
+}
@@ -0,0 +1,142 @@
+// countries.io
+// Copyright (C) 2019 Allen B
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program. If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"errors"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+
+	"github.com/gorilla/websocket"
+)
+
+const (
+	maxChatLength = 200
+
+	// Each connection can send chatRateCount messages per chatRatePeriod
+	chatRateCount  = 5
+	chatRatePeriod = 5 * time.Second
+)
+
+var errEmptyChat = errors.New("empty message")
+
+// Function chatFilter cleans up chat messages before they are sent.
+// Replace it to use a different profanity filter.
+var chatFilter = newWordFilter(nil)
+
+// Function newWordFilter returns a chat filter that replaces the given words with asterisks
+func newWordFilter(words []string) func(string) string {
+	if len(words) == 0 {
+		return func(text string) string { return text }
+	}
+	quoted := make([]string, 0, len(words))
+	for _, word := range words {
+		quoted = append(quoted, regexp.QuoteMeta(word))
+	}
+	re := regexp.MustCompile(`(?i)\b(` + strings.Join(quoted, "|") + `)\b`)
+	return func(text string) string {
+		return re.ReplaceAllStringFunc(text, func(word string) string {
+			return strings.Repeat("*", utf8.RuneCountInString(word))
+		})
+	}
+}
+
+// Type rateLimiter allows Count events every Period
+type rateLimiter struct {
+	Count  int
+	Period time.Duration
+
+	times []time.Time
+}
+
+// Method Allow records an event and returns false if there were too many
+func (r *rateLimiter) Allow() bool {
+	now := time.Now()
+	for len(r.times) > 0 && now.Sub(r.times[0]) > r.Period {
+		r.times = r.times[1:]
+	}
+	if len(r.times) >= r.Count {
+		return false
+	}
+	r.times = append(r.times, now)
+	return true
+}
+
+// Method Idle returns true if there were no events in the last Period
+func (r *rateLimiter) Idle() bool {
+	return len(r.times) == 0 || time.Since(r.times[len(r.times)-1]) > r.Period
+}
+
+var chatLimiters = struct {
+	Map map[*websocket.Conn]*rateLimiter
+	sync.Mutex
+}{
+	Map: make(map[*websocket.Conn]*rateLimiter),
+}
+
+// Function chatText checks a chat message sent by a connection and returns the text to send.
+// It returns an error to tell the sender about if the message should be dropped. Empty
+// messages are dropped with errEmptyChat, which isn't worth telling anyone about.
+func chatText(conn *websocket.Conn, args []string) (string, error) {
+	text := strings.Join(args, " ")
+	if text == "" {
+		return "", errEmptyChat
+	}
+	if utf8.RuneCountInString(text) > maxChatLength {
+		return "", errors.New("message too long")
+	}
+
+	chatLimiters.Lock()
+	limiter, ok := chatLimiters.Map[conn]
+	if !ok {
+		limiter = &rateLimiter{Count: chatRateCount, Period: chatRatePeriod}
+		chatLimiters.Map[conn] = limiter
+	}
+	allowed := limiter.Allow()
+	chatLimiters.Unlock()
+	if !allowed {
+		return "", errors.New("slow down")
+	}
+
+	return chatFilter(text), nil
+}
+
+// Function chatClose forgets the chat limiter of a connection that went away
+func chatClose(conn *websocket.Conn) {
+	chatLimiters.Lock()
+	delete(chatLimiters.Map, conn)
+	chatLimiters.Unlock()
+}
+
+// Type chatMessage is a chat message sent during a game
+type chatMessage struct {
+	Turn    int    `json:"turn"`
+	Country int    `json:"country"`
+	Team    bool   `json:"team"`
+	Text    string `json:"text"`
+}
+
+// Chat history of running games
+var chatLogs = struct {
+	Map map[string][]chatMessage
+	sync.Mutex
+}{
+	Map: make(map[string][]chatMessage),
+}
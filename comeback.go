@@ -0,0 +1,166 @@
+// countries.io
+// Copyright (C) 2019 Allen B
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program. If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"errors"
+	"strings"
+)
+
+// Type Rules are the optional rules of a game
+type Rules struct {
+	// A country that lost its capital gets a new one in its biggest city
+	RebuildCapital bool `json:"rebuild_capital"`
+
+	// Over-extended countries lose rural land to rebels
+	Rebels bool `json:"rebels"`
+
+	// Big countries grow slower
+	GrowthPenalty bool `json:"growth_penalty"`
+
+	// The map has barbarian camps
+	Barbarians bool `json:"barbarians"`
+}
+
+// The rules used by rooms that don't set their own. They're all off unless the
+// operator turns them on with -rules, so the balance of the modes doesn't change.
+var defaultRules = Rules{}
+
+// Method Set turns a rule on or off by name
+func (r *Rules) Set(name string, on bool) error {
+	switch name {
+	case "rebuild_capital":
+		r.RebuildCapital = on
+	case "rebels":
+		r.Rebels = on
+	case "growth_penalty":
+		r.GrowthPenalty = on
+	case "barbarians":
+		r.Barbarians = on
+	default:
+		return errors.New("unknown rule " + name)
+	}
+	return nil
+}
+
+// Function parseRules parses a comma-separated list of rules to turn on
+func parseRules(list string) (Rules, error) {
+	rules := Rules{}
+	for _, name := range strings.Split(list, ",") {
+		if name == "" {
+			continue
+		}
+		if err := rules.Set(name, true); err != nil {
+			return rules, err
+		}
+	}
+	return rules, nil
+}
+
+const (
+	// Turns without a capital before a city becomes the new capital
+	capitalRebuildTurns = 100
+
+	// Rebels show up every rebelInterval turns in countries with more than
+	// rebelLandFactor times the average land and at least rebelMinLand tiles.
+	// One rural tile in every rebelLandPerTile turns to rebels.
+	rebelInterval    = 50
+	rebelLandFactor  = 2
+	rebelMinLand     = 100
+	rebelLandPerTile = 50
+	rebelArmy        = 5
+
+	// Rural and suburb growth is slowed by one step per growthPenaltyLand tiles
+	growthPenaltyLand = 150
+)
+
+// Returns how many times slower a country's land grows
+func (g *Game) growthFactor(land uint) int {
+	if !g.Rules.GrowthPenalty {
+		return 1
+	}
+	return 1 + int(land)/growthPenaltyLand
+}
+
+// Gives countries that have been without a capital for long enough a new one
+func (g *Game) rebuildCapitals(hasCapital []bool) {
+	for country := range g.Countries {
+		if hasCapital[country] || g.Losers[country] {
+			g.CapitalLost[country] = -1
+			continue
+		}
+		if g.CapitalLost[country] < 0 {
+			g.CapitalLost[country] = g.Turn
+		}
+		if !g.Rules.RebuildCapital || g.Turn-g.CapitalLost[country] < capitalRebuildTurns {
+			continue
+		}
+
+		best := -1
+		for _, city := range g.buildingTiles(BUILDING_CITY) {
+			if g.Terrain[city] == country && (best < 0 || g.Armies[city] > g.Armies[best]) {
+				best = city
+			}
+		}
+		if best < 0 {
+			continue
+		}
+		g.setBuilding(best, BUILDING_CAPITAL)
+		g.ConvertAround(best, 2, country, TILE_EMPTY)
+		g.CapitalLost[country] = -1
+	}
+}
+
+// Turns rural land of over-extended countries into rebel land
+func (g *Game) rebel(land []uint) {
+	if !g.Rules.Rebels || g.Turn%rebelInterval != 0 || g.Turn == 0 {
+		return
+	}
+
+	total, alive := uint(0), uint(0)
+	for country, count := range land {
+		if !g.Losers[country] {
+			total += count
+			alive++
+		}
+	}
+	if alive == 0 {
+		return
+	}
+	average := total / alive
+
+	for country, count := range land {
+		if g.Losers[country] || count < rebelMinLand || count <= average*rebelLandFactor {
+			continue
+		}
+
+		rural := make([]int, 0)
+		for tile, terrain := range g.Terrain {
+			if terrain == country && !g.TileSpecial(tile) && g.TileType(tile) == TILE_RURAL {
+				rural = append(rural, tile)
+			}
+		}
+		for n := int(count) / rebelLandPerTile; n > 0 && len(rural) > 0; n-- {
+			i := g.random.Intn(len(rural))
+			tile := rural[i]
+			rural = append(rural[:i], rural[i+1:]...)
+
+			g.setTerrain(tile, TILE_EMPTY)
+			g.setArmies(tile, rebelArmy)
+		}
+	}
+}
@@ -0,0 +1,241 @@
+// countries.io
+// Copyright (C) 2019 Allen B
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program. If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+
+	"github.com/gorilla/websocket"
+)
+
+const (
+	// Longest websocket message read from a client
+	maxCommandLength = 1024
+
+	// Commands each connection can send per second
+	gameCommandRate = 30
+	roomCommandRate = 10
+
+	// Connections that go over the rate more than maxDroppedCommands times
+	// in droppedCommandsPeriod are disconnected
+	maxDroppedCommands    = 100
+	droppedCommandsPeriod = 10 * time.Second
+
+	// How long a command waits for room in a full action channel before it's dropped
+	actionTimeout = 300 * time.Millisecond
+)
+
+// Type gameCommand is a command from a player in a game, checked against the game
+type gameCommand struct {
+	Name string
+
+	// attack: from and to, build commands: the tile
+	From int
+	To   int
+	Half bool
+
+	// propose, accept, decline, break
+	Country int
+	Pact    int
+
+	Tech string   // research
+	Text []string // chat, chat_team
+}
+
+// Commands that take exactly one tile
+var tileCommands = map[string]bool{
+	"city": true, "wall": true, "school": true, "portal": true,
+	"collect": true, "launcher": true, "relocate": true,
+}
+
+// Function parseGameCommand checks the arguments of a command sent during a game.
+// Tiles and countries have to exist in the game.
+func parseGameCommand(args []string, game *Game) (gameCommand, error) {
+	if len(args) == 0 {
+		return gameCommand{}, errors.New("empty command")
+	}
+	command := gameCommand{Name: args[0]}
+	wantArgs := func(n int) error {
+		if len(args) != n {
+			return fmt.Errorf("%s takes %d arguments", args[0], n-1)
+		}
+		return nil
+	}
+
+	var err error
+	switch {
+	case args[0] == "attack":
+		if err := wantArgs(4); err != nil {
+			return command, err
+		}
+		if command.From, err = parseIndex(args[1], len(game.Terrain)); err != nil {
+			return command, err
+		}
+		if command.To, err = parseIndex(args[2], len(game.Terrain)); err != nil {
+			return command, err
+		}
+		if args[3] != "0" && args[3] != "1" {
+			return command, errors.New("half has to be 0 or 1")
+		}
+		command.Half = args[3] == "1"
+	case tileCommands[args[0]]:
+		if err := wantArgs(2); err != nil {
+			return command, err
+		}
+		if command.To, err = parseIndex(args[1], len(game.Terrain)); err != nil {
+			return command, err
+		}
+	case args[0] == "propose" || args[0] == "accept" || args[0] == "decline" || args[0] == "break":
+		if args[0] == "propose" {
+			err = wantArgs(3)
+		} else {
+			err = wantArgs(2)
+		}
+		if err != nil {
+			return command, err
+		}
+		if command.Country, err = parseIndex(args[1], len(game.Countries)); err != nil {
+			return command, err
+		}
+		if args[0] == "propose" {
+			pact, ok := pactNames[args[2]]
+			if !ok {
+				return command, fmt.Errorf("unknown pact %q", args[2])
+			}
+			command.Pact = pact
+		}
+	case args[0] == "research":
+		if err := wantArgs(2); err != nil {
+			return command, err
+		}
+		if _, ok := techsById[args[1]]; !ok {
+			return command, fmt.Errorf("unknown tech %q", args[1])
+		}
+		command.Tech = args[1]
+	case args[0] == "pause" || args[0] == "unpause" || args[0] == "surrender":
+		if err := wantArgs(1); err != nil {
+			return command, err
+		}
+	case args[0] == "chat" || args[0] == "chat_team":
+		if len(args) < 2 {
+			return command, errors.New("empty chat message")
+		}
+		command.Text = args[1:]
+	default:
+		return command, fmt.Errorf("unknown command %q", args[0])
+	}
+	return command, nil
+}
+
+// Parses a tile or country index, which has to be below n
+func parseIndex(s string, n int) (int, error) {
+	i, err := strconv.Atoi(s)
+	if err != nil {
+		return 0, err
+	}
+	if i < 0 || i >= n {
+		return 0, fmt.Errorf("%d is out of range", i)
+	}
+	return i, nil
+}
+
+const (
+	// Longest country name, in characters
+	maxNameLength = 32
+
+	// Longest name of a custom room, after custom/
+	maxRoomNameLength = 64
+)
+
+// Returns whether a room can be joined: a mode or a custom room
+func validRoomId(id string) bool {
+	if _, ok := roomModes[id]; ok {
+		return true
+	}
+	name := strings.TrimPrefix(id, "custom/")
+	return name != id && name != "" && len(name) <= maxRoomNameLength && utf8.ValidString(name)
+}
+
+// Returns whether a country name can be used
+func validCountryName(name string) bool {
+	return name != "" && utf8.ValidString(name) && utf8.RuneCountInString(name) <= maxNameLength
+}
+
+// Function readCommands reads commands from a websocket and passes them to handle until
+// the websocket closes. Connections that keep sending more than rate commands a second,
+// or send messages longer than maxCommandLength, are disconnected. Whatever way the
+// connection ends, its per-connection state is cleaned up.
+//
+// lock is the lock held by everything else that writes to the connection: roomConns or gameConns.
+func readCommands(conn *websocket.Conn, rate int, lock sync.Locker, handle func(*websocket.Conn, int, []string)) {
+	conn.SetReadLimit(maxCommandLength)
+	limiter := &rateLimiter{Count: rate, Period: time.Second}
+	dropped := &rateLimiter{Count: maxDroppedCommands, Period: droppedCommandsPeriod}
+	defer chatClose(conn)
+	defer forgetConnIP(conn)
+
+	for {
+		mt, msg, err := conn.ReadMessage()
+		if _, ok := err.(*websocket.CloseError); ok {
+			handle(conn, websocket.CloseMessage, nil)
+			return
+		}
+		if err == websocket.ErrReadLimit {
+			logDebug("message too long from " + connIP(conn))
+			handle(conn, websocket.CloseMessage, nil)
+			closeConn(conn, lock, "message too long")
+			return
+		}
+		if err != nil {
+			// The connection dropped without a close message
+			log.Println(err)
+			handle(conn, websocket.CloseMessage, nil)
+			return
+		}
+
+		if !limiter.Allow() {
+			metrics.DroppedCommands.Inc("rate")
+			if !dropped.Allow() {
+				logDebug("too many commands from " + connIP(conn))
+				lock.Lock()
+				conn.WriteMessage(websocket.TextMessage, []byte("error too many commands"))
+				lock.Unlock()
+				handle(conn, websocket.CloseMessage, nil)
+				closeConn(conn, lock, "too many commands")
+				return
+			}
+			continue
+		}
+		handle(conn, mt, strings.Fields(string(msg)))
+	}
+}
+
+// Tells a client why it's being disconnected, then disconnects it
+func closeConn(conn *websocket.Conn, lock sync.Locker, reason string) {
+	message := websocket.FormatCloseMessage(websocket.ClosePolicyViolation, reason)
+	lock.Lock()
+	conn.WriteControl(websocket.CloseMessage, message, time.Now().Add(time.Second))
+	lock.Unlock()
+	conn.Close()
+}
@@ -0,0 +1,347 @@
+// countries.io
+// Copyright (C) 2019 Allen B
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program. If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"math/rand"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// A 10x10 game with two countries
+func commandTestGame() *Game {
+	return NewGame([]string{"a", "b"}, 10, 10, squareTopology{}, false, 1)
+}
+
+func TestParseIndex(t *testing.T) {
+	tests := []struct {
+		s    string
+		n    int
+		want int
+		ok   bool
+	}{
+		{"0", 10, 0, true},
+		{"9", 10, 9, true},
+		{"10", 10, 0, false},
+		{"-1", 10, 0, false},
+		{"", 10, 0, false},
+		{"+1", 10, 1, true},
+		{"0x1", 10, 0, false},
+		{"1e1", 10, 0, false},
+		{" 1", 10, 0, false},
+		{"99999999999999999999", 10, 0, false},
+		{"-9223372036854775808", 10, 0, false},
+		{"0", 0, 0, false},
+	}
+	for _, test := range tests {
+		got, err := parseIndex(test.s, test.n)
+		if (err == nil) != test.ok || got != test.want {
+			t.Errorf("parseIndex(%q, %d) = %d, %v; want %d, ok %v", test.s, test.n, got, err, test.want, test.ok)
+		}
+	}
+}
+
+func TestParseGameCommand(t *testing.T) {
+	g := commandTestGame()
+	tests := []struct {
+		line string
+		want *gameCommand // nil if the command is rejected
+	}{
+		{"attack 0 1 0", &gameCommand{Name: "attack", From: 0, To: 1}},
+		{"attack 0 99 1", &gameCommand{Name: "attack", From: 0, To: 99, Half: true}},
+		{"attack 0 100 0", nil},
+		{"attack -1 0 0", nil},
+		{"attack 0 1 2", nil},
+		{"attack 0 1", nil},
+		{"attack 0 1 0 0", nil},
+		{"city 5", &gameCommand{Name: "city", To: 5}},
+		{"relocate 99", &gameCommand{Name: "relocate", To: 99}},
+		{"wall 100", nil},
+		{"school", nil},
+		{"portal 1 2", nil},
+		{"propose 1 peace", &gameCommand{Name: "propose", Country: 1, Pact: pactNames["peace"]}},
+		{"propose 1 war", nil},
+		{"propose 2 peace", nil},
+		{"accept 0", &gameCommand{Name: "accept", Country: 0}},
+		{"break 1 peace", nil},
+		{"research granary", &gameCommand{Name: "research", Tech: "granary"}},
+		{"research nope", nil},
+		{"pause", &gameCommand{Name: "pause"}},
+		{"unpause now", nil},
+		{"chat hello there", &gameCommand{Name: "chat", Text: []string{"hello", "there"}}},
+		{"chat_team", nil},
+		{"ATTACK 0 1 0", nil},
+		{"", nil},
+	}
+	for _, test := range tests {
+		got, err := parseGameCommand(strings.Fields(test.line), g)
+		if test.want == nil {
+			if err == nil {
+				t.Errorf("%q was accepted as %+v", test.line, got)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%q was rejected: %v", test.line, err)
+			continue
+		}
+		if got.Name != test.want.Name || got.From != test.want.From || got.To != test.want.To || got.Half != test.want.Half ||
+			got.Country != test.want.Country || got.Pact != test.want.Pact || got.Tech != test.want.Tech ||
+			strings.Join(got.Text, " ") != strings.Join(test.want.Text, " ") {
+			t.Errorf("%q = %+v, want %+v", test.line, got, *test.want)
+		}
+	}
+}
+
+// Command names the randomized test sends, including some that don't exist
+var randomCommandNames = []string{
+	"attack", "city", "wall", "school", "portal", "collect", "launcher", "relocate",
+	"propose", "accept", "decline", "break", "research", "pause", "unpause",
+	"chat", "chat_team", "surrender", "join", "", "ATTACK", "city2",
+}
+
+// Returns a random argument: often a number near the edges of the map, sometimes junk
+func randomArg(random *rand.Rand, g *Game) string {
+	switch random.Intn(8) {
+	case 0, 1, 2:
+		return strconv.Itoa(random.Intn(len(g.Terrain)+20) - 10)
+	case 3:
+		return strconv.Itoa(random.Intn(len(g.Countries)+4) - 2)
+	case 4:
+		return []string{"99999999999999999999", "-9223372036854775808", "+1", "0x10", "1e3", "-0", " ", "\x00"}[random.Intn(8)]
+	case 5:
+		return []string{"truce", "peace", "alliance", "war", "granary", "portals", "nope", "0", "1"}[random.Intn(9)]
+	case 6:
+		b := make([]byte, random.Intn(6))
+		random.Read(b)
+		return string(b)
+	default:
+		return ""
+	}
+}
+
+// Sends random commands through the parser and plays the ones it accepts the way a
+// game thread does. Nothing a client sends should crash a game or break its totals.
+// It's a randomized test with a fixed seed rather than a fuzzer, since go.mod is older
+// than go test's fuzzing; change the seed to try other commands.
+func TestParseGameCommandRandomized(t *testing.T) {
+	random := rand.New(rand.NewSource(1))
+	countries := []string{"a", "b", "c", "d"}
+	newGame := func() *Game {
+		return NewGame(countries, 20, 20, squareTopology{}, false, random.Int63())
+	}
+	g := newGame()
+	stats := newGameStats(len(countries))
+
+	accepted := 0
+	for i := 0; i < 20000; i++ {
+		args := []string{randomCommandNames[random.Intn(len(randomCommandNames))]}
+		for j := random.Intn(5); j > 0; j-- {
+			args = append(args, randomArg(random, g))
+		}
+		command, err := parseGameCommand(args, g)
+		if err != nil {
+			continue
+		}
+		accepted++
+
+		country := random.Intn(len(g.Countries))
+		switch {
+		case command.Name == "attack":
+			g.Attack(country, command.From, command.To, command.Half)
+		case tileCommands[command.Name]:
+			playBuild(g, stats, command.Name, country, command.To)
+		case command.Name == "propose" || command.Name == "accept" || command.Name == "decline" || command.Name == "break":
+			playDiplomacy(g, country, diplomacyAction{Action: command.Name, Country: command.Country, Pact: command.Pact})
+		case command.Name == "research":
+			g.Research(country, command.Tech)
+		}
+
+		if i%20 == 0 {
+			g.NextTurn()
+			if err := g.checkConsistency(); err != nil {
+				t.Fatalf("after %d commands: %v", i, err)
+			}
+		}
+		if g.Ended() {
+			g = newGame()
+			stats = newGameStats(len(countries))
+		}
+	}
+	if accepted == 0 {
+		t.Fatal("no command was accepted")
+	}
+}
+
+func TestRateLimiter(t *testing.T) {
+	limiter := &rateLimiter{Count: 3, Period: 50 * time.Millisecond}
+	for i := 0; i < 3; i++ {
+		if !limiter.Allow() {
+			t.Fatalf("event %d wasn't allowed", i)
+		}
+	}
+	if limiter.Allow() {
+		t.Fatal("a 4th event in the period was allowed")
+	}
+	time.Sleep(60 * time.Millisecond)
+	if !limiter.Allow() {
+		t.Fatal("an event after the period wasn't allowed")
+	}
+}
+
+// Starts a server that reads commands at rate a second, and connects to it.
+// Every call to the handler is sent on the returned channel. Chat messages go
+// through chatText, so the connection gets a chat limiter like it would in a game.
+func commandTestServer(t *testing.T, rate int) (*websocket.Conn, <-chan int) {
+	calls := make(chan int, 1000)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := gameUpgrader.Upgrade(w, r, nil)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		setConnIP(conn, r)
+		readCommands(conn, rate, &gameConns, func(conn *websocket.Conn, mt int, args []string) {
+			if mt == websocket.TextMessage && args[0] == "chat" {
+				chatText(conn, args[1:])
+			}
+			calls <- mt
+		})
+		close(calls)
+	}))
+	t.Cleanup(server.Close)
+
+	conn, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(server.URL, "http"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return conn, calls
+}
+
+// Reads from a connection until it closes and returns the close error and the text messages
+func readUntilClose(t *testing.T, conn *websocket.Conn) (*websocket.CloseError, []string) {
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	messages := make([]string, 0)
+	for {
+		_, msg, err := conn.ReadMessage()
+		if err != nil {
+			closeErr, ok := err.(*websocket.CloseError)
+			if !ok {
+				t.Fatalf("connection ended without a close message: %v", err)
+			}
+			return closeErr, messages
+		}
+		messages = append(messages, string(msg))
+	}
+}
+
+// Counts the commands a handler got, checking that the last call was for the close
+func countCommands(t *testing.T, calls <-chan int) int {
+	commands, closed := 0, false
+	for mt := range calls {
+		if closed {
+			t.Fatal("the handler got a command after the close")
+		}
+		if mt == websocket.CloseMessage {
+			closed = true
+		} else {
+			commands++
+		}
+	}
+	if !closed {
+		t.Fatal("the handler wasn't told the connection closed")
+	}
+	return commands
+}
+
+func TestReadCommandsDisconnectsFlooding(t *testing.T) {
+	conn, calls := commandTestServer(t, 5)
+	for i := 0; i < 5+maxDroppedCommands+10; i++ {
+		if err := conn.WriteMessage(websocket.TextMessage, []byte("pause")); err != nil {
+			break
+		}
+	}
+
+	closeErr, messages := readUntilClose(t, conn)
+	if closeErr.Code != websocket.ClosePolicyViolation {
+		t.Errorf("closed with %v, want a policy violation", closeErr)
+	}
+	if len(messages) == 0 || messages[len(messages)-1] != "error too many commands" {
+		t.Errorf("got %q before the close, want an error", messages)
+	}
+	if commands := countCommands(t, calls); commands != 5 {
+		t.Errorf("the handler got %d commands, want the 5 allowed", commands)
+	}
+}
+
+func TestReadCommandsAllowsSteadyCommands(t *testing.T) {
+	conn, calls := commandTestServer(t, 100)
+	for i := 0; i < 50; i++ {
+		if err := conn.WriteMessage(websocket.TextMessage, []byte("pause")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	conn.WriteMessage(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""))
+	readUntilClose(t, conn)
+	if commands := countCommands(t, calls); commands != 50 {
+		t.Errorf("the handler got %d commands, want 50", commands)
+	}
+}
+
+// Returns how many connections have an IP address and a chat limiter kept for them
+func connectionState() (int, int) {
+	connIPs.Lock()
+	ips := len(connIPs.Map)
+	connIPs.Unlock()
+	chatLimiters.Lock()
+	limiters := len(chatLimiters.Map)
+	chatLimiters.Unlock()
+	return ips, limiters
+}
+
+func TestReadCommandsDisconnectsLongMessages(t *testing.T) {
+	ipsBefore, limitersBefore := connectionState()
+	conn, calls := commandTestServer(t, gameCommandRate)
+	conn.WriteMessage(websocket.TextMessage, []byte("chat hello"))
+	<-calls
+	if ips, limiters := connectionState(); ips != ipsBefore+1 || limiters != limitersBefore+1 {
+		t.Errorf("%d IP addresses and %d chat limiters are kept while connected, want %d and %d",
+			ips, limiters, ipsBefore+1, limitersBefore+1)
+	}
+
+	conn.WriteMessage(websocket.TextMessage, []byte("chat "+strings.Repeat("a", maxCommandLength)))
+	closeErr, _ := readUntilClose(t, conn)
+	if closeErr.Code != websocket.CloseMessageTooBig && closeErr.Code != websocket.ClosePolicyViolation {
+		t.Errorf("closed with %v, want message too big", closeErr)
+	}
+	if commands := countCommands(t, calls); commands != 0 {
+		t.Errorf("the handler got %d commands after the long one, want none", commands)
+	}
+
+	// Whatever way a connection ends, what's kept about it goes away
+	if ips, limiters := connectionState(); ips != ipsBefore || limiters != limitersBefore {
+		t.Errorf("%d IP addresses and %d chat limiters are kept after disconnecting, want %d and %d",
+			ips, limiters, ipsBefore, limitersBefore)
+	}
+}
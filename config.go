@@ -0,0 +1,286 @@
+// countries.io
+// Copyright (C) 2019 Allen B
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program. If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Type serverConfig is everything that can be set in the config file.
+// Every field also has a flag, and flags given on the command line win over the file.
+type serverConfig struct {
+	Listen  string `json:"listen"`
+	TLSCert string `json:"tls_cert"`
+	TLSKey  string `json:"tls_key"`
+	// Pages and images are built into the program. With Dev they're read from
+	// Static on every request instead, so they can be edited without building again.
+	Static   string `json:"static"`
+	Dev      bool   `json:"dev"`
+	LogLevel string `json:"log_level"`
+
+	AdminToken string `json:"admin_token"`
+	Bans       string `json:"bans"`
+	// Without this, everyone behind a reverse proxy seems to come from the proxy
+	TrustedProxies string `json:"trusted_proxies"`
+
+	// Each mode is served at /<name>, so it can't be named after another page like admin.
+	// In the config file it's written as "modes": {"2v2": {"players": 4, "is_2v2": true}}.
+	Modes          modeList `json:"modes"`
+	LobbyCountdown duration `json:"lobby_countdown"`
+	Speed          string   `json:"speed"`
+	// Hosts of custom rooms choose their own rules
+	Rules       string `json:"rules"`
+	BannedWords string `json:"banned_words"`
+
+	History    string   `json:"history"`
+	Maps       string   `json:"maps"`
+	Snapshots  string   `json:"snapshots"`
+	Checkpoint duration `json:"checkpoint"`
+	Drain      duration `json:"drain"`
+}
+
+// Type modeConfig is a kind of public room
+type modeConfig struct {
+	Players int  `json:"players"`
+	Is2v2   bool `json:"is_2v2"`
+}
+
+// Type modeList is the public rooms by name. As a flag it's written like 1v1=2,2v2=2v2,ffa=6.
+type modeList map[string]modeConfig
+
+// Type duration is a time.Duration written like 2m30s in the config file
+type duration struct {
+	time.Duration
+}
+
+func (d *duration) UnmarshalJSON(data []byte) error {
+	var s string
+	if err := json.Unmarshal(data, &s); err != nil {
+		return err
+	}
+	parsed, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+	d.Duration = parsed
+	return nil
+}
+
+func (d duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(d.String())
+}
+
+func (m modeList) String() string {
+	names := make([]string, 0, len(m))
+	for name := range m {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	out := make([]string, 0, len(m))
+	for _, name := range names {
+		if m[name].Is2v2 {
+			out = append(out, name+"=2v2")
+		} else {
+			out = append(out, name+"="+strconv.Itoa(m[name].Players))
+		}
+	}
+	return strings.Join(out, ",")
+}
+
+// Method Set replaces the modes with the ones in a flag
+func (m modeList) Set(s string) error {
+	modes := make(modeList)
+	for _, part := range strings.Split(s, ",") {
+		kv := strings.SplitN(strings.TrimSpace(part), "=", 2)
+		if len(kv) != 2 {
+			return fmt.Errorf("mode %q should look like name=players", part)
+		}
+		if kv[1] == "2v2" {
+			modes[kv[0]] = modeConfig{Players: 4, Is2v2: true}
+			continue
+		}
+		players, err := strconv.Atoi(kv[1])
+		if err != nil {
+			return fmt.Errorf("mode %q: %v", part, err)
+		}
+		modes[kv[0]] = modeConfig{Players: players}
+	}
+	for name := range m {
+		delete(m, name)
+	}
+	for name, mode := range modes {
+		m[name] = mode
+	}
+	return nil
+}
+
+var modeNamePattern = regexp.MustCompile(`^[a-z0-9_-]{1,16}$`)
+
+const (
+	// Public rooms can have between 2 and maxModePlayers players
+	maxModePlayers = 6
+
+	defaultPort = "8080"
+)
+
+// Function defaultConfig returns the settings used when nothing else is given
+func defaultConfig() *serverConfig {
+	port := os.Getenv("PORT")
+	if port == "" {
+		port = defaultPort
+	}
+	return &serverConfig{
+		Listen:   ":" + port,
+		Static:   ".",
+		LogLevel: "info",
+		Modes: modeList{
+			"1v1": {Players: 2},
+			"2v2": {Players: 4, Is2v2: true},
+			"ffa": {Players: 6},
+		},
+		LobbyCountdown: duration{2 * time.Minute},
+		Speed:          "normal",
+		History:        "history",
+		Maps:           "maps",
+		Snapshots:      "snapshots",
+		Checkpoint:     duration{30 * time.Second},
+		// Hosts usually kill the process 30s after SIGTERM
+		Drain: duration{20 * time.Second},
+	}
+}
+
+// Method addFlags adds a flag for every setting
+func (c *serverConfig) addFlags(flags *flag.FlagSet) {
+	flags.StringVar(&c.Listen, "listen", c.Listen, "address to serve on, :$PORT by default")
+	flags.StringVar(&c.TLSCert, "tls-cert", c.TLSCert, "certificate file, to serve over TLS")
+	flags.StringVar(&c.TLSKey, "tls-key", c.TLSKey, "key file, to serve over TLS")
+	flags.StringVar(&c.Static, "static", c.Static, "directory with the pages, styles and images, used with -dev")
+	flags.BoolVar(&c.Dev, "dev", c.Dev, "serve pages and images from -static instead of the copies built into the program")
+	flags.StringVar(&c.LogLevel, "log-level", c.LogLevel, "what to log: debug (which adds players joining and leaving rooms), info or error")
+	flags.StringVar(&c.AdminToken, "admin-token", c.AdminToken, "token to use /admin with, to spectate and end games, ban players and send announcements; empty to disable it")
+	flags.StringVar(&c.Bans, "bans", c.Bans, "file to keep banned players in, empty to only keep them until restart")
+	flags.StringVar(&c.TrustedProxies, "trusted-proxies", c.TrustedProxies, "comma-separated IPs or CIDR ranges of reverse proxies, whose X-Forwarded-For header gives players' IP addresses")
+	flags.Var(c.Modes, "modes", "public rooms and their players, like 1v1=2,2v2=2v2,ffa=6")
+	flags.DurationVar(&c.LobbyCountdown.Duration, "lobby-countdown", c.LobbyCountdown.Duration, "how long a room waits for more players once two have joined")
+	flags.StringVar(&c.Speed, "speed", c.Speed, "default game speed: slow, normal, fast or a tick length in ms")
+	flags.StringVar(&c.Rules, "rules", c.Rules, "comma-separated rules to use in public rooms: rebuild_capital, rebels, growth_penalty and barbarians")
+	flags.StringVar(&c.BannedWords, "banned-words", c.BannedWords, "file with whitespace-separated words to filter out of chat")
+	flags.StringVar(&c.History, "history", c.History, "directory to save finished games in, served at /api/games; empty to disable")
+	flags.StringVar(&c.Maps, "maps", c.Maps, "directory to keep maps made at /editor in, for custom rooms to play on; empty to disable")
+	flags.StringVar(&c.Snapshots, "snapshots", c.Snapshots, "directory to save running games in, which carry on when the program starts again; empty to disable")
+	flags.DurationVar(&c.Checkpoint.Duration, "checkpoint", c.Checkpoint.Duration, "how often running games are saved")
+	flags.DurationVar(&c.Drain.Duration, "drain", c.Drain.Duration, "how long running games get to finish after SIGTERM or an interrupt before they're saved and the program exits")
+}
+
+// Method load reads a JSON config file. Settings missing from the file are left alone.
+func (c *serverConfig) load(path string) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	loaded := *c
+	// Modes in the file replace the default ones instead of adding to them
+	loaded.Modes = nil
+	decoder := json.NewDecoder(file)
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(&loaded); err != nil {
+		return fmt.Errorf("%s: %v", path, err)
+	}
+	if loaded.Modes != nil {
+		for name := range c.Modes {
+			delete(c.Modes, name)
+		}
+		for name, mode := range loaded.Modes {
+			c.Modes[name] = mode
+		}
+	}
+	loaded.Modes = c.Modes
+	*c = loaded
+	return nil
+}
+
+// Method check returns an error if a setting doesn't make sense
+func (c *serverConfig) check() error {
+	if (c.TLSCert == "") != (c.TLSKey == "") {
+		return errors.New("tls_cert and tls_key have to be set together")
+	}
+	if _, ok := logLevels[c.LogLevel]; !ok {
+		return fmt.Errorf("unknown log level %q", c.LogLevel)
+	}
+	if len(c.Modes) == 0 {
+		return errors.New("there has to be at least one mode")
+	}
+	for name, mode := range c.Modes {
+		if !modeNamePattern.MatchString(name) {
+			return fmt.Errorf("%q can't be the name of a mode", name)
+		}
+		if mode.Is2v2 && mode.Players != 4 {
+			return fmt.Errorf("mode %s: 2v2 rooms have 4 players", name)
+		}
+		if mode.Players < 2 || mode.Players > maxModePlayers {
+			return fmt.Errorf("mode %s: rooms have 2 to %d players", name, maxModePlayers)
+		}
+	}
+	if c.LobbyCountdown.Duration <= 0 {
+		return errors.New("lobby_countdown has to be positive")
+	}
+	if c.Checkpoint.Duration <= 0 {
+		return errors.New("checkpoint has to be positive")
+	}
+	return nil
+}
+
+const (
+	levelDebug = iota
+	levelInfo
+	levelError
+)
+
+var logLevels = map[string]int{
+	"debug": levelDebug,
+	"info":  levelInfo,
+	"error": levelError,
+}
+
+// What gets logged. Errors always are.
+var logLevel = levelInfo
+
+// Logs what the server is doing, like games starting
+func logInfo(v ...interface{}) {
+	if logLevel <= levelInfo {
+		log.Println(v...)
+	}
+}
+
+// Logs details that are only useful when looking for a bug, like players joining rooms
+func logDebug(v ...interface{}) {
+	if logLevel <= levelDebug {
+		log.Println(v...)
+	}
+}
@@ -0,0 +1,193 @@
+// countries.io
+// Copyright (C) 2019 Allen B
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program. If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"encoding/json"
+)
+
+const (
+	// Pact types
+	PACT_TRUCE    = 1 // No attacks until it runs out
+	PACT_PEACE    = 2 // Non-aggression pact, no attacks until broken
+	PACT_ALLIANCE = 3 // No attacks, and armies can be sent to allies
+
+	// How many turns a truce lasts
+	truceLength = 100
+
+	// How many turns after a pact is broken before attacks land
+	pactCooldown = 20
+)
+
+var pactNames = map[string]int{
+	"truce":    PACT_TRUCE,
+	"peace":    PACT_PEACE,
+	"alliance": PACT_ALLIANCE,
+}
+
+// Type Pact is an agreement between two countries
+type Pact struct {
+	Type int `json:"type"`
+
+	// Truces and broken pacts stop protecting on this turn
+	Until  int  `json:"until"`
+	Broken bool `json:"broken"`
+}
+
+// Returns the key of two countries in Game.Pacts
+func pactKey(country1 int, country2 int) [2]int {
+	if country1 > country2 {
+		return [2]int{country2, country1}
+	}
+	return [2]int{country1, country2}
+}
+
+// Method HasDiplomacy returns true if countries can make pacts: in free-for-all games
+// of 3 or more. With only two countries a pact would just stop the game.
+func (g *Game) HasDiplomacy() bool {
+	return !g.Is2v2 && len(g.Countries) >= 3
+}
+
+// Method Propose offers a pact to another country.
+// If the other country already proposed the same pact, it is accepted.
+func (g *Game) Propose(countryIndex int, otherIndex int, pactType int) bool {
+	if !g.HasDiplomacy() || countryIndex == otherIndex ||
+		otherIndex < 0 || otherIndex >= len(g.Countries) ||
+		g.Losers[countryIndex] || g.Losers[otherIndex] {
+		return false
+	}
+	if pactType != PACT_TRUCE && pactType != PACT_PEACE && pactType != PACT_ALLIANCE {
+		return false
+	}
+	if pact := g.Pacts[pactKey(countryIndex, otherIndex)]; pact != nil && !pact.Broken && pact.Type == pactType {
+		return false
+	}
+
+	if g.Proposals[[2]int{otherIndex, countryIndex}] == pactType {
+		return g.Accept(countryIndex, otherIndex)
+	}
+	g.Proposals[[2]int{countryIndex, otherIndex}] = pactType
+	g.DiplomacyVersion++
+	return true
+}
+
+// Method Accept accepts a pact proposed by another country
+func (g *Game) Accept(countryIndex int, otherIndex int) bool {
+	pactType, ok := g.Proposals[[2]int{otherIndex, countryIndex}]
+	if !ok || g.Losers[countryIndex] || g.Losers[otherIndex] {
+		return false
+	}
+	delete(g.Proposals, [2]int{otherIndex, countryIndex})
+	delete(g.Proposals, [2]int{countryIndex, otherIndex})
+
+	pact := &Pact{Type: pactType}
+	if pactType == PACT_TRUCE {
+		pact.Until = g.Turn + truceLength
+	}
+	g.Pacts[pactKey(countryIndex, otherIndex)] = pact
+	g.DiplomacyVersion++
+	return true
+}
+
+// Method Decline turns down a pact proposed by another country
+func (g *Game) Decline(countryIndex int, otherIndex int) bool {
+	if _, ok := g.Proposals[[2]int{otherIndex, countryIndex}]; !ok {
+		return false
+	}
+	delete(g.Proposals, [2]int{otherIndex, countryIndex})
+	g.DiplomacyVersion++
+	return true
+}
+
+// Method Break breaks a pact. Attacks between the two countries
+// don't land until pactCooldown turns later.
+func (g *Game) Break(countryIndex int, otherIndex int) bool {
+	pact := g.Pacts[pactKey(countryIndex, otherIndex)]
+	if pact == nil || pact.Broken {
+		return false
+	}
+	pact.Broken = true
+	pact.Until = g.Turn + pactCooldown
+	g.DiplomacyVersion++
+	return true
+}
+
+// Method CanAttack returns false if a pact keeps a country from attacking another
+func (g *Game) CanAttack(countryIndex int, otherIndex int) bool {
+	if otherIndex < 0 || countryIndex == otherIndex {
+		return true
+	}
+	pact := g.Pacts[pactKey(countryIndex, otherIndex)]
+	if pact == nil {
+		return true
+	}
+	if pact.Broken || pact.Type == PACT_TRUCE {
+		return g.Turn >= pact.Until
+	}
+	return false
+}
+
+// Method IsAllied returns true if two countries have an alliance
+func (g *Game) IsAllied(country1 int, country2 int) bool {
+	if country1 < 0 || country2 < 0 || country1 == country2 {
+		return false
+	}
+	pact := g.Pacts[pactKey(country1, country2)]
+	return pact != nil && pact.Type == PACT_ALLIANCE && !pact.Broken
+}
+
+// Removes pacts that ran out and pacts and proposals of countries that lost
+func (g *Game) updatePacts() {
+	for key, pact := range g.Pacts {
+		if g.Losers[key[0]] || g.Losers[key[1]] ||
+			((pact.Broken || pact.Type == PACT_TRUCE) && g.Turn >= pact.Until) {
+			delete(g.Pacts, key)
+			g.DiplomacyVersion++
+		}
+	}
+	for key, _ := range g.Proposals {
+		if g.Losers[key[0]] || g.Losers[key[1]] {
+			delete(g.Proposals, key)
+			g.DiplomacyVersion++
+		}
+	}
+}
+
+// Method MarshalDiplomacy creates json of the pacts and proposals
+func (g *Game) MarshalDiplomacy() ([]byte, error) {
+	type pactJSON struct {
+		Countries [2]int `json:"countries"`
+		Pact
+	}
+	type proposalJSON struct {
+		From int `json:"from"`
+		To   int `json:"to"`
+		Type int `json:"type"`
+	}
+	pacts := make([]pactJSON, 0, len(g.Pacts))
+	for key, pact := range g.Pacts {
+		pacts = append(pacts, pactJSON{key, *pact})
+	}
+	proposals := make([]proposalJSON, 0, len(g.Proposals))
+	for key, pactType := range g.Proposals {
+		proposals = append(proposals, proposalJSON{key[0], key[1], pactType})
+	}
+	return json.Marshal(map[string]interface{}{
+		"pacts":     pacts,
+		"proposals": proposals,
+	})
+}
@@ -0,0 +1,53 @@
+// countries.io
+// Copyright (C) 2019 Allen B
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program. If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import "testing"
+
+func TestDiplomacyOnlyInFreeForAll(t *testing.T) {
+	tests := []struct {
+		countries []string
+		is2v2     bool
+		want      bool
+	}{
+		{[]string{"a", "b"}, false, false},
+		{[]string{"a", "b", "c", "d"}, true, false},
+		{[]string{"a", "b", "c"}, false, true},
+		{[]string{"a", "b", "c", "d", "e", "f"}, false, true},
+	}
+	for _, test := range tests {
+		g := NewGame(test.countries, 20, 20, squareTopology{}, test.is2v2, 1)
+		if got := g.HasDiplomacy(); got != test.want {
+			t.Errorf("%d countries, 2v2 %v: HasDiplomacy() = %v", len(test.countries), test.is2v2, got)
+		}
+		if got := g.Propose(0, 1, PACT_ALLIANCE); got != test.want {
+			t.Errorf("%d countries, 2v2 %v: Propose() = %v", len(test.countries), test.is2v2, got)
+		}
+	}
+}
+
+// The last two countries have to fight it out, even if they're allies
+func TestAlliesDontEndTheGame(t *testing.T) {
+	g := NewGame([]string{"a", "b", "c"}, 20, 20, squareTopology{}, false, 1)
+	if !g.Propose(0, 1, PACT_ALLIANCE) || !g.Accept(1, 0) {
+		t.Fatal("couldn't make an alliance")
+	}
+	g.Leave(2)
+	if g.Ended() {
+		t.Error("the game ended with two allies left")
+	}
+}
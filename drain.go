@@ -0,0 +1,126 @@
+// countries.io
+// Copyright (C) 2019 Allen B
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program. If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// How long running games get to stop after being told to
+const stopTimeout = 10 * time.Second
+
+// Whether the server is shutting down
+var shutdown = struct {
+	Draining bool
+	Deadline time.Time
+
+	// Closed when draining starts, so running games save a snapshot straight away
+	Checkpoint chan struct{}
+
+	// Closed when the games still running should stop
+	Stop chan struct{}
+	sync.Mutex
+}{
+	Checkpoint: make(chan struct{}),
+	Stop:       make(chan struct{}),
+}
+
+// The game threads that haven't finished
+var runningGames sync.WaitGroup
+
+// Function startRunning counts a game thread that's about to start. It returns false,
+// and the game shouldn't start, if the server is draining. Games are added under the
+// same lock drain takes to set Draining, so none can be added once drain is waiting.
+func startRunning() bool {
+	shutdown.Lock()
+	defer shutdown.Unlock()
+	if shutdown.Draining {
+		return false
+	}
+	runningGames.Add(1)
+	return true
+}
+
+func isDraining() bool {
+	shutdown.Lock()
+	defer shutdown.Unlock()
+	return shutdown.Draining
+}
+
+// Function drain stops the server from starting games and waits up to timeout
+// for the running ones to finish. Running games are checkpointed as soon as
+// draining starts, in case the process is killed before they stop. Games still
+// running after timeout, or after a signal on hurry, are saved again and stopped.
+func drain(timeout time.Duration, hurry <-chan os.Signal) {
+	shutdown.Lock()
+	shutdown.Draining = true
+	shutdown.Deadline = time.Now().Add(timeout)
+	close(shutdown.Checkpoint)
+	shutdown.Unlock()
+
+	message := []byte(fmt.Sprintf("server_shutdown %d", int(timeout.Seconds())))
+	roomConns.Lock()
+	for conn := range roomConns.Map {
+		conn.WriteMessage(websocket.TextMessage, message)
+	}
+	roomConns.Unlock()
+	gameConns.Lock()
+	for conn := range gameConns.Map {
+		conn.WriteMessage(websocket.TextMessage, message)
+	}
+	gameConns.Unlock()
+
+	done := make(chan struct{})
+	go func() {
+		runningGames.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return
+	case <-time.After(timeout):
+	case <-hurry:
+	}
+
+	logInfo("stopping running games")
+	close(shutdown.Stop)
+	select {
+	case <-done:
+	case <-time.After(stopTimeout):
+		log.Println("some games didn't stop in time")
+	}
+}
+
+// Called by a game thread when the server shuts down. Saves the game if snapshots are enabled.
+func stopGame(gameId string, game *Game, settings gameSettings, thread gameThread, st *threadState) {
+	if snapshots == nil {
+		log.Println("stopped " + gameId + " without saving it")
+		return
+	}
+	if err := snapshots.Save(newSnapshot(gameId, game, settings, thread, st)); err != nil {
+		log.Println(err)
+		return
+	}
+	logInfo("saved " + gameId)
+}
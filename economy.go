@@ -0,0 +1,110 @@
+// countries.io
+// Copyright (C) 2019 Allen B
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program. If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+const (
+	// Food and upkeep are counted every economyInterval turns
+	economyInterval = 10
+
+	startingGold = 50
+
+	// Food made by a rural tile every economyInterval turns
+	foodPerRural = 1
+
+	// Every armyPerFood soldiers above freeArmy eat one food
+	freeArmy    = 200
+	armyPerFood = 50
+
+	// Building costs
+	costCity     = 30
+	costSchool   = 15
+	costWall     = 20
+	costPortal   = 500
+	costLauncher = 500
+	costRelocate = 100
+
+	// Gold upkeep of buildings every economyInterval turns
+	upkeepSchool   = 1
+	upkeepPortal   = 5
+	upkeepLauncher = 5
+)
+
+// Method Spend takes gold out of a country's treasury.
+// It returns false if the country doesn't have enough.
+func (g *Game) Spend(countryIndex int, gold int) bool {
+	if g.Gold[countryIndex] < gold {
+		return false
+	}
+	g.Gold[countryIndex] -= gold
+	return true
+}
+
+// Pays food and upkeep. rural is the number of rural tiles of each country.
+//
+// Countries that run out of food starve: every tile loses an army.
+// Countries that can't pay upkeep lose a tenth of the armies in their buildings.
+func (g *Game) updateEconomy(rural []int) {
+	if g.Turn%economyInterval != 0 || g.Turn == 0 {
+		return
+	}
+
+	_, soldiers, _ := g.Totals()
+	upkeep := make([]int, len(g.Countries))
+	for country, totals := range g.totals {
+		for buildingType, count := range totals.Buildings {
+			upkeep[country] += buildingKinds[buildingType].Upkeep * count
+		}
+	}
+
+	starving := make([]bool, len(g.Countries))
+	broke := make([]bool, len(g.Countries))
+	for country := range g.Countries {
+		if g.Losers[country] {
+			continue
+		}
+
+		g.Food[country] += rural[country] * foodPerRural
+		if g.HasTech(country, "granary") {
+			g.Food[country] += rural[country] * foodPerRural
+		}
+		if soldiers[country] > freeArmy {
+			g.Food[country] -= int(soldiers[country]-freeArmy) / armyPerFood
+		}
+		if g.Food[country] < 0 {
+			g.Food[country] = 0
+			starving[country] = true
+		}
+
+		g.Gold[country] -= upkeep[country]
+		if g.Gold[country] < 0 {
+			g.Gold[country] = 0
+			broke[country] = true
+		}
+	}
+
+	for tile, terrain := range g.Terrain {
+		if terrain < 0 {
+			continue
+		}
+		if starving[terrain] && g.Armies[tile] > 1 && !g.Has(tile, BUILDING_SCHOOL) {
+			g.setArmies(tile, g.Armies[tile]-1)
+		}
+		if broke[terrain] && g.kind(tile).Upkeep > 0 {
+			g.setArmies(tile, g.Armies[tile]-g.Armies[tile]/10)
+		}
+	}
+}
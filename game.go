@@ -18,15 +18,14 @@ package main
 
 import (
 	"encoding/json"
-	"log"
 	"math/rand"
-	"sort"
 )
 
 const (
 	// Tile constants for Game.Terrain
-	TILE_EMPTY = -1
-	TILE_WALL  = -2
+	TILE_EMPTY     = -1
+	TILE_WALL      = -2
+	TILE_BARBARIAN = -3 // Neutral barbarian faction, doesn't count as a country
 )
 
 // Type Game represents a game
@@ -34,144 +33,188 @@ type Game struct {
 	// The names of the countries
 	Countries []string // name = [countryId]
 
-	Width  int
-	Height int
+	Width    int
+	Height   int
+	Topology Topology
 
-	Terrain   []int        // countryId = [tileIndex]
-	Armies    []uint       // army = [tileIndex]
-	Cities    map[int]bool // isCity = [tileIndex]
-	Capitals  map[int]bool // isCaptial = [tileIndex]
-	Schools   map[int]bool
-	Launchers map[int]bool
-	Portals   map[int]bool
+	Terrain   []int      // countryId = [tileIndex]
+	Armies    []uint     // army = [tileIndex]
+	Buildings []Building // building = [tileIndex], see building.go
+
+	tileTypes []int           // tileType = [tileIndex], see index.go
+	totals    []countryTotals // totals = [countryId], see totals.go
 
 	Losers map[int]bool // People who lost
 
+	// Treasury
+	Gold []int // gold = [countryId]
+	Food []int // food = [countryId]
+
+	ResearchPoints []int             // points = [countryId]
+	Techs          []map[string]bool // hasTech = [countryId][techId]
+
+	Pacts     map[[2]int]*Pact // pact = [pactKey(country1, country2)]
+	Proposals map[[2]int]int   // pactType = [[from, to]]
+
+	// Changes whenever Pacts or Proposals change
+	DiplomacyVersion int
+
 	// The current turn #
 	Turn int
 
 	Is2v2 bool
+
+	// The seed used to generate the map
+	Seed int64
+
+	Rules Rules
+
+	// The turn each country lost its capital, -1 if it has one
+	CapitalLost []int
+
+	// The turn each country last relocated its capital, -1 if never
+	LastRelocate []int
+
+	random *rand.Rand
 }
 
 // Function NewGame creates and returns a new Game
-func NewGame(countries []string, width int, height int, is2v2 bool) *Game {
+func NewGame(countries []string, width int, height int, topology Topology, is2v2 bool, seed int64) *Game {
+	g := newEmptyGame(countries, width, height, topology, is2v2, seed)
+
+	for country, capital := range g.placeSpawns(len(countries)) {
+		g.placeCapital(country, capital)
+	}
+
+	return g
+}
+
+// Function newEmptyGame creates a Game of unowned land without any capitals
+func newEmptyGame(countries []string, width int, height int, topology Topology, is2v2 bool, seed int64) *Game {
 	size := width * height
 	g := &Game{
 		Countries: countries,
 		Terrain:   make([]int, size),
+		tileTypes: make([]int, size),
+		totals:    make([]countryTotals, len(countries)),
 		Armies:    make([]uint, size),
-		Cities:    make(map[int]bool),
-		Capitals:  make(map[int]bool),
-		Schools:   make(map[int]bool),
-		Portals:   make(map[int]bool),
+		Buildings: make([]Building, size),
 		Losers:    make(map[int]bool),
-		Launchers: make(map[int]bool),
+		Gold:      make([]int, len(countries)),
+		Food:      make([]int, len(countries)),
+		Pacts:     make(map[[2]int]*Pact),
+		Proposals: make(map[[2]int]int),
 		Turn:      0,
 		Width:     width,
 		Height:    height,
+		Topology:  topology,
 		Is2v2:     is2v2,
+		Seed:      seed,
+		random:    rand.New(rand.NewSource(seed)),
+	}
+	g.CapitalLost = make([]int, len(countries))
+	g.LastRelocate = make([]int, len(countries))
+	for country := range g.CapitalLost {
+		g.CapitalLost[country] = -1
+		g.LastRelocate[country] = -1
 	}
 
 	// Reset to -1
 	for index, _ := range g.Terrain {
 		g.Terrain[index] = TILE_EMPTY
+		g.tileTypes[index] = TILE_EMPTY
 	}
-
-	var capitals []int
-	switch len(g.Countries) {
-	case 2:
-		capitals = []int{0, size - 1}
-	case 3: // TODO: this isn't even
-		capitals = []int{0, size - 1, g.Width - 1}
-	case 4:
-		capitals = []int{0, g.Width - 1, size - 1, size - g.Width}
-	case 6:
-		capitals = []int{0, size - 1, g.Width - 1, size - g.Width, g.Width / 2, size - g.Width/2}
-		// TODO: 5
-	}
-
-	if capitals == nil {
-		for countryIndex, _ := range g.Countries {
-		makecapital:
-			for {
-				index := rand.Intn(size)
-				if _, ok := g.Capitals[index]; ok {
-					continue
-				}
-				for _, tileAround := range g.TilesAround(index, 18) {
-					if g.Capitals[tileAround] {
-						log.Println("Capital too close, getting another")
-						continue makecapital
-					}
-				}
-
-				g.Terrain[index] = countryIndex
-				g.Capitals[index] = true
-				g.ConvertAround(index, 2, countryIndex, TILE_EMPTY)
-
-				break
-			}
-		}
-	} else {
-		for country, capital := range capitals {
-			g.Capitals[capital] = true
-			g.Terrain[capital] = country
-			g.ConvertAround(capital, 2, country, TILE_EMPTY)
-		}
+	g.ResearchPoints = make([]int, len(countries))
+	g.Techs = make([]map[string]bool, len(countries))
+	for country := range g.Gold {
+		g.Gold[country] = startingGold
+		g.Techs[country] = make(map[string]bool)
 	}
 
 	return g
 }
 
+// Gives a country its first capital
+func (g *Game) placeCapital(country int, tile int) {
+	g.setTerrain(tile, country)
+	g.setBuilding(tile, BUILDING_CAPITAL)
+	g.ConvertAround(tile, 2, country, TILE_EMPTY)
+}
+
 // Method NextTurn
 func (g *Game) NextTurn() {
 	var hasCapital = make([]bool, len(g.Countries))
-	for capital, _ := range g.Capitals {
-		hasCapital[g.Terrain[capital]] = true
+	for country := range g.Countries {
+		hasCapital[country] = g.HasCapital(country)
 	}
+	g.rebuildCapitals(hasCapital)
+	for country := range g.Countries {
+		hasCapital[country] = g.HasCapital(country)
+	}
+	rural := make([]int, len(g.Countries))
+	land, _, _ := g.Totals()
 
-outer:
 	for index, terrain := range g.Terrain {
-		// Don't increase anything for not-in-game-anymore people
-		for loser, _ := range g.Losers {
-			if terrain == loser {
-				continue outer
-			}
-		}
-
 		if terrain < 0 {
 			continue
 		}
+		// Don't increase anything for not-in-game-anymore people
+		if g.Losers[terrain] {
+			continue
+		}
 		if !hasCapital[terrain] {
 			if g.Turn%50 == 0 && g.Turn != 0 {
-				g.Armies[index] += 1
+				g.setArmies(index, g.Armies[index]+1)
+			}
+			// Cities still pay taxes, so the country can afford to relocate
+			if g.Turn%2 == 0 && g.Has(index, BUILDING_CITY) {
+				g.Gold[terrain] += 1
 			}
+			rural[terrain]++
 			continue
 		}
 
+		growth := g.growthFactor(land[terrain])
 		switch g.TileType(index) {
 		case TILE_RURAL:
-			if g.Turn%50 == 0 && g.Turn != 0 {
-				g.Armies[index] += 1
+			rural[terrain]++
+			if g.Turn%(50*growth) == 0 && g.Turn != 0 {
+				g.setArmies(index, g.Armies[index]+1)
 			}
 			continue
 		case TILE_SUBURB:
-			if g.Turn%2 == 0 && g.Schools[index] {
-				g.Armies[index] += 1
+			if g.Turn%2 == 0 && g.Has(index, BUILDING_SCHOOL) {
+				g.setArmies(index, g.Armies[index]+1)
 			}
-			if g.Turn%20 == 0 && g.Turn != 0 {
-				g.Armies[index] += 1
+			if g.Turn%(20*growth) == 0 && g.Turn != 0 {
+				g.setArmies(index, g.Armies[index]+1)
 			}
 		case TILE_URBAN:
-			if g.Turn%2 == 0 && g.Cities[index] {
-				g.Armies[index] += 1
+			if g.Turn%2 == 0 && g.Has(index, BUILDING_CITY) {
+				g.setArmies(index, g.Armies[index]+1)
+				g.Gold[terrain] += 1
 			}
-			if g.Capitals[index] {
-				g.Armies[index] += 1
+			if g.Has(index, BUILDING_CAPITAL) {
+				g.setArmies(index, g.Armies[index]+1)
+				g.Gold[terrain] += 1
+				if g.HasTech(terrain, "taxes") {
+					g.Gold[terrain] += 1
+				}
 			}
 		}
 	}
+	g.updateEconomy(rural)
+	g.updateResearch()
+	g.updateBarbarians()
+	g.rebel(land)
 	g.Turn++
+	g.updatePacts()
+
+	if debugChecks {
+		if err := g.checkConsistency(); err != nil {
+			panic(err)
+		}
+	}
 }
 
 // Method Attack causes a country to move armies
@@ -186,31 +229,30 @@ func (g *Game) Attack(countryIndex int, fromTileIndex int, toTileIndex int, isHa
 		return true
 	}
 
-	fromRow := fromTileIndex / g.Width
-	toRow := toTileIndex / g.Width
-	fromCol := fromTileIndex % g.Width
-	toCol := toTileIndex % g.Width
-	if !((fromRow == toRow && (fromCol-toCol == 1 || fromCol-toCol == -1)) || (fromCol == toCol && (fromRow-toRow == 1 || fromRow-toRow == -1))) {
-		if g.Portals[fromTileIndex] && g.Terrain[toTileIndex] == countryIndex && g.Portals[toTileIndex] {
+	if !g.IsNeighbor(fromTileIndex, toTileIndex) {
+		if g.Has(fromTileIndex, BUILDING_PORTAL) && g.Terrain[toTileIndex] == countryIndex && g.Has(toTileIndex, BUILDING_PORTAL) {
 			// do nothing
-		} else if g.Launchers[fromTileIndex] {
+		} else if g.Has(fromTileIndex, BUILDING_LAUNCHER) {
 			// Launch
 			for _, tile := range g.TilesAround(toTileIndex, 1) {
+				if !g.CanAttack(countryIndex, g.Terrain[tile]) {
+					continue
+				}
 				val := g.Armies[fromTileIndex] / 4
-				if g.Schools[tile] {
+				if g.Has(tile, BUILDING_SCHOOL) {
 					val /= 5
 				}
 				if g.Armies[tile] > val {
-					g.Armies[tile] -= val
+					g.setArmies(tile, g.Armies[tile]-val)
 				} else {
-					if g.Capitals[tile] || g.Schools[tile] {
-						g.Armies[tile] = 1
+					if g.Has(tile, BUILDING_CAPITAL) || g.Has(tile, BUILDING_SCHOOL) {
+						g.setArmies(tile, 1)
 					} else {
 						g.DeleteTile(tile)
 					}
 				}
 			}
-			g.Armies[fromTileIndex] = 1
+			g.setArmies(fromTileIndex, 1)
 			return true
 		} else {
 			return false
@@ -228,42 +270,54 @@ func (g *Game) Attack(countryIndex int, fromTileIndex int, toTileIndex int, isHa
 	}
 
 	if g.IsSameTeam(g.Terrain[toTileIndex], countryIndex) {
-		if g.Schools[toTileIndex] || g.Schools[fromTileIndex] {
+		if g.Has(toTileIndex, BUILDING_SCHOOL) || g.Has(fromTileIndex, BUILDING_SCHOOL) {
 			return false
 		}
-		g.Armies[toTileIndex] += targetArmy
-		if !g.Capitals[toTileIndex] {
-			g.Terrain[toTileIndex] = countryIndex
+		g.setArmies(toTileIndex, g.Armies[toTileIndex]+targetArmy)
+		if !g.Has(toTileIndex, BUILDING_CAPITAL) {
+			g.setTerrain(toTileIndex, countryIndex)
+		}
+	} else if g.IsAllied(g.Terrain[toTileIndex], countryIndex) {
+		// Send armies to an ally
+		if g.Has(toTileIndex, BUILDING_SCHOOL) || g.Has(fromTileIndex, BUILDING_SCHOOL) {
+			return false
 		}
+		g.setArmies(toTileIndex, g.Armies[toTileIndex]+targetArmy)
 	} else {
 		toCountry := g.Terrain[toTileIndex]
+		if !g.CanAttack(countryIndex, toCountry) {
+			return false
+		}
 		if targetArmy > g.Armies[toTileIndex] { // win
-			g.Armies[toTileIndex] = targetArmy - g.Armies[toTileIndex]
+			g.setArmies(toTileIndex, targetArmy-g.Armies[toTileIndex])
 
-			if g.Cities[toTileIndex] {
+			if g.Has(toTileIndex, BUILDING_CITY) {
 				g.ConvertAround(toTileIndex, 1, countryIndex, g.Terrain[toTileIndex])
 			}
 
-			if g.Capitals[toTileIndex] {
+			if g.Has(toTileIndex, BUILDING_CAPITAL) {
 				g.ConvertAround(toTileIndex, 2, countryIndex, g.Terrain[toTileIndex])
 
-				delete(g.Capitals, toTileIndex)
-				g.Cities[toTileIndex] = true
+				g.setBuilding(toTileIndex, BUILDING_CITY)
 			}
 
-			if g.Schools[toTileIndex] {
-				delete(g.Schools, toTileIndex)
+			if g.Has(toTileIndex, BUILDING_SCHOOL) {
+				g.setBuilding(toTileIndex, BUILDING_NONE)
 			}
 
-			g.Terrain[toTileIndex] = countryIndex
+			if g.Has(toTileIndex, BUILDING_CAMP) {
+				g.captureCamp(countryIndex, toTileIndex)
+			}
+
+			g.setTerrain(toTileIndex, countryIndex)
 		} else if targetArmy < g.Armies[toTileIndex] { // lose
 			if g.Terrain[toTileIndex] == TILE_WALL {
 				return false
 			} else {
-				g.Armies[toTileIndex] -= targetArmy
+				g.setArmies(toTileIndex, g.Armies[toTileIndex]-targetArmy)
 			}
 		} else if targetArmy == g.Armies[toTileIndex] { // tie
-			if !g.Capitals[toTileIndex] {
+			if !g.Has(toTileIndex, BUILDING_CAPITAL) {
 				g.DeleteTile(toTileIndex)
 			}
 		}
@@ -273,33 +327,34 @@ func (g *Game) Attack(countryIndex int, fromTileIndex int, toTileIndex int, isHa
 		}
 	}
 
-	g.Armies[fromTileIndex] = remainingArmy
+	g.setArmies(fromTileIndex, remainingArmy)
 	return true
 }
 
 // Method MakeCity creates a city
 func (g *Game) MakeCity(countryIndex int, tileIndex int) bool {
-	if g.Terrain[tileIndex] != countryIndex || g.Armies[tileIndex] < 31 ||
-		g.Cities[tileIndex] || g.Capitals[tileIndex] || g.Schools[tileIndex] || g.Portals[tileIndex] {
+	if g.Terrain[tileIndex] != countryIndex || g.TileSpecial(tileIndex) {
 		return false
 	}
 	for _, tile := range g.TilesAround(tileIndex, 4) {
-		if g.Cities[tile] || g.Capitals[tile] {
+		if g.kind(tile).Urban {
 			return false // Can't make a city too close to a city/capital
 		}
 	}
 	if !g.HasCapital(countryIndex) {
 		return false
 	}
+	if !g.Spend(countryIndex, costCity) {
+		return false
+	}
 
-	g.Armies[tileIndex] -= 30
-	g.Cities[tileIndex] = true
+	g.setBuilding(tileIndex, BUILDING_CITY)
 	g.ConvertAround(tileIndex, 1, countryIndex, TILE_EMPTY)
 	return true
 }
 
 func (g *Game) MakeWall(countryIndex int, tileIndex int) bool {
-	if g.Scientists(countryIndex) < 200 {
+	if !g.HasTech(countryIndex, "walls") {
 		return false
 	}
 	if g.Terrain[tileIndex] != countryIndex {
@@ -311,13 +366,16 @@ func (g *Game) MakeWall(countryIndex int, tileIndex int) bool {
 	if !g.HasCapital(countryIndex) {
 		return false
 	}
+	if !g.Spend(countryIndex, costWall) {
+		return false
+	}
 	if g.Armies[tileIndex] < uint(g.Turn)/100*100 {
-		g.Armies[tileIndex] = uint(g.Turn) / 100 * 100
+		g.setArmies(tileIndex, uint(g.Turn)/100*100)
 	}
 	if g.Armies[tileIndex] > 9999 {
-		g.Armies[tileIndex] = 9999
+		g.setArmies(tileIndex, 9999)
 	}
-	g.Terrain[tileIndex] = TILE_WALL
+	g.setTerrain(tileIndex, TILE_WALL)
 	return true
 }
 
@@ -334,39 +392,32 @@ func (g *Game) MakeSchool(countryIndex int, tileIndex int) bool {
 	if g.TileType(tileIndex) != TILE_SUBURB {
 		return false
 	}
-	if g.Armies[tileIndex] <= 15 {
-		return false
-	}
-
-	schoolcount := 0
-	for school, _ := range g.Schools {
-		if g.Terrain[school] == countryIndex {
-			schoolcount++
-		}
-	}
 
-	if schoolcount >= 3 {
+	if g.totals[countryIndex].Buildings[BUILDING_SCHOOL] >= 3 {
 		return false
 	}
 
 	targetCity := -1
 	for _, city := range g.TilesAround(tileIndex, 2) {
-		if g.Terrain[city] == countryIndex && (g.Cities[city] || g.Capitals[city]) {
+		if g.Terrain[city] == countryIndex && g.kind(city).Urban {
 			targetCity = city
 		}
 	}
 	if targetCity == -1 {
 		return false
 	}
+	if !g.Spend(countryIndex, costSchool) {
+		return false
+	}
 
-	g.Armies[targetCity] += g.Armies[tileIndex] - 15
-	g.Armies[tileIndex] = 0
-	g.Schools[tileIndex] = true
+	g.setArmies(targetCity, g.Armies[targetCity]+g.Armies[tileIndex])
+	g.setArmies(tileIndex, 0)
+	g.setBuilding(tileIndex, BUILDING_SCHOOL)
 	return true
 }
 
 func (g *Game) MakePortal(countryIndex int, tileIndex int) bool {
-	if g.Scientists(countryIndex) < 1000 {
+	if !g.HasTech(countryIndex, "portals") {
 		return false
 	}
 	if g.Terrain[tileIndex] != countryIndex {
@@ -381,90 +432,64 @@ func (g *Game) MakePortal(countryIndex int, tileIndex int) bool {
 	if g.TileType(tileIndex) != TILE_SUBURB {
 		return false
 	}
-	if g.Armies[tileIndex] <= 500 {
+	if !g.Spend(countryIndex, costPortal) {
 		return false
 	}
-	g.Portals[tileIndex] = true
-	g.Armies[tileIndex] -= 500
+	g.setBuilding(tileIndex, BUILDING_PORTAL)
 	return true
 }
 
 // Collects army in 5x5
 func (g *Game) Collect(countryIndex int, tileIndex int) bool {
-	if g.Scientists(countryIndex) < 50 {
+	if !g.HasTech(countryIndex, "collect") {
 		return false
 	}
 	if g.Terrain[tileIndex] != countryIndex {
 		return false
 	}
-	if g.Schools[tileIndex] {
+	if g.Has(tileIndex, BUILDING_SCHOOL) {
 		return false
 	}
 
 	total := uint(0)
 
-	centerRow := tileIndex / g.Width
-	centerCol := tileIndex % g.Width
-	startCol := centerCol - 2
-	if startCol < 0 {
-		startCol = 0
-	}
-	endCol := centerCol + 2
-	if endCol >= g.Width {
-		endCol = g.Width - 1
-	}
-	startRow := centerRow - 2
-	if startRow < 0 {
-		startRow = 0
-	}
-	endRow := centerRow + 2
-	if endRow >= g.Height {
-		endRow = g.Height - 1
+	// Only tiles within 2 steps are collected
+	area := make(map[int]bool)
+	for _, tile := range g.TilesAround(tileIndex, 2) {
+		area[tile] = true
 	}
 
 	// Which tiles are reachable (i.e. a wall doesn't block)
 	reachable := make(map[int]bool)
 	var makeReachable func(int)
 	makeReachable = func(tile int) {
-		if reachable[tile] {
+		if reachable[tile] || !area[tile] {
 			return
 		}
-		row := tile / g.Width
-		col := tile % g.Width
-		//		log.Printf("Tile (%d, %d) Limits (%d-%d %d-%d)\n", row, col, startRow, endRow, startCol, endCol)
 		if g.Terrain[tile] != countryIndex {
 			return
 		}
 		reachable[tile] = true
-		if col > startCol {
-			makeReachable(tile - 1)
-		}
-		if col < endCol {
-			makeReachable(tile + 1)
-		}
-		if row > startRow {
-			makeReachable(tile - g.Width)
-		}
-		if row < endRow {
-			makeReachable(tile + g.Width)
+		for _, neighbor := range g.Neighbors(tile) {
+			makeReachable(neighbor)
 		}
 	}
 	makeReachable(tileIndex)
 
 	for tileAround, _ := range reachable {
-		if g.Terrain[tileAround] == countryIndex && !g.Schools[tileAround] && g.Armies[tileAround] >= 2 {
+		if g.Terrain[tileAround] == countryIndex && !g.Has(tileAround, BUILDING_SCHOOL) && g.Armies[tileAround] >= 2 {
 			total += g.Armies[tileAround] - 1
-			g.Armies[tileAround] = 1
+			g.setArmies(tileAround, 1)
 		}
 	}
 
-	g.Armies[tileIndex] = total + 1
+	g.setArmies(tileIndex, total+1)
 
 	return true
 }
 
 func (g *Game) MakeLauncher(countryIndex int, tileIndex int) bool {
-	if g.Scientists(countryIndex) < 500 {
+	if !g.HasTech(countryIndex, "launchers") {
 		return false
 	}
 	if g.Terrain[tileIndex] != countryIndex {
@@ -479,24 +504,47 @@ func (g *Game) MakeLauncher(countryIndex int, tileIndex int) bool {
 	if g.TileType(tileIndex) != TILE_SUBURB {
 		return false
 	}
-	if g.Armies[tileIndex] <= 500 {
+	if !g.Spend(countryIndex, costLauncher) {
 		return false
 	}
 
-	g.Armies[tileIndex] -= 500
-	g.Launchers[tileIndex] = true
+	g.setBuilding(tileIndex, BUILDING_LAUNCHER)
 
 	return true
 }
 
+// Turns between capital relocations
+const relocateCooldown = 200
+
+// Method Relocate turns one of a country's cities into its capital.
+// If the country still has a capital, that capital becomes a city.
+func (g *Game) Relocate(countryIndex int, tileIndex int) bool {
+	if g.Terrain[tileIndex] != countryIndex || !g.Has(tileIndex, BUILDING_CITY) {
+		return false
+	}
+	if g.LastRelocate[countryIndex] >= 0 && g.Turn-g.LastRelocate[countryIndex] < relocateCooldown {
+		return false
+	}
+	if !g.Spend(countryIndex, costRelocate) {
+		return false
+	}
+
+	for _, capital := range g.buildingTiles(BUILDING_CAPITAL) {
+		if g.Terrain[capital] == countryIndex {
+			g.setBuilding(capital, BUILDING_CITY)
+		}
+	}
+	g.setBuilding(tileIndex, BUILDING_CAPITAL)
+	g.ConvertAround(tileIndex, 2, countryIndex, TILE_EMPTY)
+	g.LastRelocate[countryIndex] = g.Turn
+	g.CapitalLost[countryIndex] = -1
+	return true
+}
+
 func (g *Game) DeleteTile(tileIndex int) {
-	g.Armies[tileIndex] = 0
-	g.Terrain[tileIndex] = TILE_EMPTY
-	delete(g.Cities, tileIndex)
-	delete(g.Capitals, tileIndex)
-	delete(g.Schools, tileIndex)
-	delete(g.Portals, tileIndex)
-	delete(g.Launchers, tileIndex)
+	g.setArmies(tileIndex, 0)
+	g.setTerrain(tileIndex, TILE_EMPTY)
+	g.setBuilding(tileIndex, BUILDING_NONE)
 }
 
 func (g *Game) Leave(countryIndex int) {
@@ -504,7 +552,7 @@ func (g *Game) Leave(countryIndex int) {
 }
 
 func (g *Game) TileSpecial(tileIndex int) bool {
-	return g.Cities[tileIndex] || g.Capitals[tileIndex] || g.Schools[tileIndex] || g.Portals[tileIndex] || g.Launchers[tileIndex]
+	return g.Buildings[tileIndex].Type != BUILDING_NONE
 }
 
 func createDiff(old []int, new_ []int) []int {
@@ -553,31 +601,18 @@ func createDiff(old []int, new_ []int) []int {
 
 // Method MarshalJSON creates json
 func (g *Game) MarshalJSON(oldterrain []int, oldarmies []uint) ([]byte, error) {
-	citylist := make([]int, 0, len(g.Cities))
-	capitallist := make([]int, 0, len(g.Capitals))
-	schools := make([]int, 0, len(g.Schools))
-	portals := make([]int, 0, len(g.Portals))
-	launchers := make([]int, 0, len(g.Launchers))
-	for city, _ := range g.Cities {
-		citylist = append(citylist, city)
-	}
-	for capital, _ := range g.Capitals {
-		capitallist = append(capitallist, capital)
-	}
-	for school, _ := range g.Schools {
-		schools = append(schools, school)
-	}
-	for portal, _ := range g.Portals {
-		portals = append(portals, portal)
+	// Tiles with each type of building, in order
+	buildings := make(map[string][]int)
+	for _, kind := range buildingKinds {
+		if kind.Name != "" {
+			buildings[kind.Name] = make([]int, 0)
+		}
 	}
-	for launcher, _ := range g.Launchers {
-		launchers = append(launchers, launcher)
+	for tile, building := range g.Buildings {
+		if name := buildingKinds[building.Type].Name; name != "" {
+			buildings[name] = append(buildings[name], tile)
+		}
 	}
-	sort.Ints(citylist)
-	sort.Ints(capitallist)
-	sort.Ints(schools)
-	sort.Ints(portals)
-	sort.Ints(launchers)
 
 	terraindiff := createDiff(oldterrain, g.Terrain)
 
@@ -594,61 +629,56 @@ func (g *Game) MarshalJSON(oldterrain []int, oldarmies []uint) ([]byte, error) {
 	//	log.Println("terrain", terraindiff)
 	//	log.Println("armies", armiesdiff)
 
-	scientists := make([]uint, len(g.Countries))
-	soldiers := make([]uint, len(g.Countries))
-	for tile, terrain := range g.Terrain {
-		if terrain >= 0 {
-			if g.Schools[tile] {
-				scientists[terrain] += g.Armies[tile]
-			} else {
-				soldiers[terrain] += g.Armies[tile]
-			}
-		}
-	}
+	_, soldiers, scientists := g.Totals()
 
-	return json.Marshal(map[string]interface{}{
+	update := map[string]interface{}{
 		"terrain_diff": terraindiff,
 		"armies_diff":  armiesdiff,
-		"cities":       citylist,
-		"schools":      schools,
-		"portals":      portals,
-		"capitals":     capitallist,
 		"turn":         g.Turn,
 		"soldiers":     soldiers,
 		"scientists":   scientists,
-		"launchers":    launchers,
-	})
+		"gold":         g.Gold,
+		"food":         g.Food,
+		"research":     g.ResearchPoints,
+		"techs":        g.techLists(),
+		"relocated":    g.LastRelocate,
+	}
+	for name, tiles := range buildings {
+		update[name] = tiles
+	}
+	return json.Marshal(update)
+}
+
+// Method Totals returns the land, soldiers and scientists of every country
+func (g *Game) Totals() (land []uint, soldiers []uint, scientists []uint) {
+	land = make([]uint, len(g.Countries))
+	scientists = make([]uint, len(g.Countries))
+	soldiers = make([]uint, len(g.Countries))
+	for country, totals := range g.totals {
+		land[country] = totals.Land
+		soldiers[country] = totals.Soldiers
+		scientists[country] = totals.Scientists
+	}
+	return land, soldiers, scientists
 }
 
 func (g *Game) TilesAround(tile int, r int) []int {
-	out := make([]int, 0)
-	tileCol := tile % g.Width
-	tileRow := tile / g.Width
-	startCol := tileCol - r
-	endCol := tileCol + r
-	startRow := tileRow - r
-	endRow := tileRow + r
+	return g.Topology.TilesAround(g.Width, g.Height, tile, r)
+}
 
-	if startCol < 0 {
-		startCol = 0
-	}
-	if endCol > g.Width-1 {
-		endCol = g.Width - 1
-	}
-	if startRow < 0 {
-		startRow = 0
-	}
-	if endRow > g.Height-1 {
-		endRow = g.Height - 1
-	}
+// Method Neighbors returns the tiles next to a tile
+func (g *Game) Neighbors(tile int) []int {
+	return g.Topology.Neighbors(g.Width, g.Height, tile)
+}
 
-	for row := startRow; row <= endRow; row++ {
-		for col := startCol; col <= endCol; col++ {
-			out = append(out, row*g.Width+col)
+// Method IsNeighbor returns true if two tiles are next to each other
+func (g *Game) IsNeighbor(tile1 int, tile2 int) bool {
+	for _, neighbor := range g.Neighbors(tile1) {
+		if neighbor == tile2 {
+			return true
 		}
 	}
-
-	return out
+	return false
 }
 
 func (g *Game) ConvertAround(tile int, r int, countryIndex int, fromCountryIndex int) {
@@ -656,10 +686,10 @@ func (g *Game) ConvertAround(tile int, r int, countryIndex int, fromCountryIndex
 		if g.Terrain[tileAround] != fromCountryIndex {
 			continue
 		}
-		if g.Armies[tileAround] < g.Armies[tile] || g.Armies[tileAround] == 0 || g.Schools[tileAround] {
-			g.Terrain[tileAround] = countryIndex
+		if g.Armies[tileAround] < g.Armies[tile] || g.Armies[tileAround] == 0 || g.Has(tileAround, BUILDING_SCHOOL) {
+			g.setTerrain(tileAround, countryIndex)
 			if g.Armies[tileAround] == 0 {
-				g.Armies[tileAround] = 1
+				g.setArmies(tileAround, 1)
 			}
 		}
 	}
@@ -671,64 +701,27 @@ const (
 	TILE_URBAN  = 2
 )
 
+// Method TileType returns whether a tile is rural, suburb or urban land,
+// or the terrain of tiles nobody owns
 func (g *Game) TileType(tile int) int {
-	if g.Terrain[tile] < 0 {
-		return g.Terrain[tile]
-	}
-	if g.Capitals[tile] || g.Cities[tile] {
-		return TILE_URBAN
-	}
-	for capital, _ := range g.Capitals {
-		if g.Terrain[capital] == g.Terrain[tile] {
-			for _, tileAround := range g.TilesAround(capital, 2) {
-				if tileAround == tile {
-					return TILE_SUBURB
-				}
-			}
-		}
-	}
-	for city, _ := range g.Cities {
-		if g.Terrain[city] == g.Terrain[tile] {
-			for _, tileAround := range g.TilesAround(city, 1) {
-				if tileAround == tile {
-					return TILE_SUBURB
-				}
-			}
-		}
-	}
-	return TILE_RURAL
+	return g.tileTypes[tile]
 }
 
 func (g *Game) checkLoss(countryIndex int) {
 	if g.Losers[countryIndex] {
 		return
 	}
-	for index, terrain := range g.Terrain {
-		if terrain == countryIndex {
-			log.Println("nope,", index)
-			return // not lost yet
-		}
+	if g.totals[countryIndex].Land == 0 {
+		g.Losers[countryIndex] = true
 	}
-	g.Losers[countryIndex] = true
 }
 
 func (g *Game) Scientists(countryIndex int) uint {
-	out := uint(0)
-	for tile, terrain := range g.Terrain {
-		if terrain == countryIndex && g.Schools[tile] {
-			out += g.Armies[tile]
-		}
-	}
-	return out
+	return g.totals[countryIndex].Scientists
 }
 
 func (g *Game) HasCapital(countryIndex int) bool {
-	for capital, _ := range g.Capitals {
-		if g.Terrain[capital] == countryIndex {
-			return true
-		}
-	}
-	return false
+	return g.totals[countryIndex].Buildings[BUILDING_CAPITAL] > 0
 }
 
 // Returns true if the game ended
@@ -748,6 +741,21 @@ func (g *Game) Ended() bool {
 	return false
 }
 
+// Returns the countries that won. Only meaningful once the game has ended.
+func (g *Game) Winners() []int {
+	winners := make([]int, 0)
+	for country := range g.Countries {
+		if g.Is2v2 {
+			if !g.Losers[country/2*2] || !g.Losers[country/2*2+1] {
+				winners = append(winners, country)
+			}
+		} else if !g.Losers[country] {
+			winners = append(winners, country)
+		}
+	}
+	return winners
+}
+
 func (g *Game) IsSameTeam(country1 int, country2 int) bool {
 	return country1 == country2 ||
 		(g.Is2v2 && country1/2 == country2/2)
@@ -1,5 +1,5 @@
 module github.com/Allen-B1/countries-io
 
-go 1.12
+go 1.16
 
 require github.com/gorilla/websocket v1.4.0
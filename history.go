@@ -0,0 +1,432 @@
+// countries.io
+// Copyright (C) 2019 Allen B
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program. If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Type gameRecord is what gets stored about a finished game
+type gameRecord struct {
+	Id   string `json:"id"`
+	Mode string `json:"mode"`
+
+	// Settings
+	Width    int    `json:"width"`
+	Height   int    `json:"height"`
+	Topology string `json:"topology"`
+	Is2v2    bool   `json:"is_2v2"`
+	Tick     int64  `json:"tick"` // ms
+	Seed     int64  `json:"seed"`
+	Rules    Rules  `json:"rules"`
+
+	Players []string `json:"players"`
+
+	// Result
+	Winners    []int `json:"winners"`
+	Eliminated []int `json:"eliminated"`
+	Turns      int   `json:"turns"`
+
+	Start    time.Time `json:"start"`
+	End      time.Time `json:"end"`
+	Duration float64   `json:"duration"` // seconds
+
+	// Path of the replay file, relative to the history directory
+	Replay string `json:"replay"`
+}
+
+// Type replay is everything needed to watch a game again
+type replay struct {
+	Players  []string          `json:"players"`
+	Width    int               `json:"width"`
+	Height   int               `json:"height"`
+	Topology string            `json:"topology"`
+	Tick     int64             `json:"tick"`
+	Updates  []json.RawMessage `json:"updates,omitempty"` // one update message per tick
+	Chat     []chatMessage     `json:"chat"`
+}
+
+// Type historyStore keeps finished games on disk.
+// Records are kept in Dir/games and replays in Dir/replays. Only what's needed to find
+// and sort the records is kept in memory, and the records themselves are read when asked for.
+type historyStore struct {
+	Dir string
+
+	entries []historyEntry // sorted by end time, oldest first
+	ids     map[string]bool
+	sync.Mutex
+}
+
+// Type historyEntry is what the history keeps in memory about a game
+type historyEntry struct {
+	Id      string    `json:"id"`
+	End     time.Time `json:"end"`
+	Players []string  `json:"players"`
+}
+
+// The history of finished games. nil if history is disabled.
+var history *historyStore
+
+// Function openHistory opens the history in a directory and indexes the records in it
+func openHistory(dir string) (*historyStore, error) {
+	h := &historyStore{
+		Dir: dir,
+		ids: make(map[string]bool),
+	}
+	for _, sub := range []string{"games", "replays"} {
+		if err := os.MkdirAll(filepath.Join(dir, sub), 0755); err != nil {
+			return nil, err
+		}
+	}
+
+	files, err := ioutil.ReadDir(filepath.Join(dir, "games"))
+	if err != nil {
+		return nil, err
+	}
+	for _, file := range files {
+		if !strings.HasSuffix(file.Name(), ".json") {
+			continue
+		}
+		data, err := ioutil.ReadFile(filepath.Join(dir, "games", file.Name()))
+		if err != nil {
+			return nil, err
+		}
+		var entry historyEntry
+		if err := json.Unmarshal(data, &entry); err != nil {
+			return nil, err
+		}
+		h.entries = append(h.entries, entry)
+		h.ids[entry.Id] = true
+	}
+	sort.Slice(h.entries, func(i, j int) bool {
+		return h.entries[i].End.Before(h.entries[j].End)
+	})
+	return h, nil
+}
+
+// Method Save writes a finished game and its replay to disk. The replay's updates
+// are copied from the game's stream, which is removed afterwards.
+func (h *historyStore) Save(record *gameRecord, rep *replay, stream *replayStream) error {
+	record.Replay = filepath.Join("replays", record.Id+".json")
+	if err := writeReplay(filepath.Join(h.Dir, record.Replay), rep, stream.Path); err != nil {
+		return err
+	}
+	if err := os.Remove(stream.Path); err != nil {
+		return err
+	}
+
+	data, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+	if err := writeFileAtomic(filepath.Join(h.Dir, "games", record.Id+".json"), data); err != nil {
+		return err
+	}
+
+	h.Lock()
+	h.entries = append(h.entries, historyEntry{Id: record.Id, End: record.End, Players: record.Players})
+	h.ids[record.Id] = true
+	h.Unlock()
+	return nil
+}
+
+// Writes a replay with the updates from a stream file, without loading them all at once
+func writeReplay(path string, rep *replay, updates string) error {
+	header := *rep
+	header.Updates = nil
+	data, err := json.Marshal(header)
+	if err != nil {
+		return err
+	}
+	in, err := os.Open(updates)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	tmp := path + ".tmp"
+	out, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+	defer out.Close()
+	w := bufio.NewWriter(out)
+	w.Write(data[:len(data)-1])
+	w.WriteString(`,"updates":[`)
+	r := bufio.NewReader(in)
+	for first := true; ; first = false {
+		line, err := r.ReadBytes('\n')
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		if !first {
+			w.WriteByte(',')
+		}
+		w.Write(line[:len(line)-1])
+	}
+	w.WriteString("]}")
+	if err := w.Flush(); err != nil {
+		return err
+	}
+	if err := out.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+// Type replayStream appends the updates of a running game to Dir/replays/<id>.updates,
+// one per line, so they don't have to be kept in memory until the game ends
+type replayStream struct {
+	Path  string
+	Count int // updates written
+
+	file   *os.File
+	writer *bufio.Writer
+}
+
+// Method Stream opens the update stream of a running game. Anything past the first
+// count updates is thrown away, since it's newer than the snapshot the game resumed from.
+func (h *historyStore) Stream(id string, count int) (*replayStream, error) {
+	path := filepath.Join(h.Dir, "replays", id+".updates")
+	file, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, err
+	}
+
+	r := bufio.NewReader(file)
+	offset, lines := int64(0), 0
+	for lines < count {
+		line, err := r.ReadBytes('\n')
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			file.Close()
+			return nil, err
+		}
+		offset += int64(len(line))
+		lines++
+	}
+	if err := file.Truncate(offset); err != nil {
+		file.Close()
+		return nil, err
+	}
+	if _, err := file.Seek(offset, io.SeekStart); err != nil {
+		file.Close()
+		return nil, err
+	}
+	return &replayStream{Path: path, Count: lines, file: file, writer: bufio.NewWriterSize(file, 64<<10)}, nil
+}
+
+// Method Add appends an update
+func (s *replayStream) Add(update []byte) error {
+	s.Count++
+	s.writer.Write(update)
+	return s.writer.WriteByte('\n')
+}
+
+// Method Flush writes out buffered updates
+func (s *replayStream) Flush() error {
+	return s.writer.Flush()
+}
+
+// Method Close flushes and closes the stream, leaving the file for Save or a resumed game
+func (s *replayStream) Close() error {
+	if err := s.writer.Flush(); err != nil {
+		s.file.Close()
+		return err
+	}
+	return s.file.Close()
+}
+
+// Method Get returns a game by id, or nil if there's no such game
+func (h *historyStore) Get(id string) (*gameRecord, error) {
+	h.Lock()
+	ok := h.ids[id]
+	h.Unlock()
+	if !ok {
+		return nil, nil
+	}
+	return h.read(id)
+}
+
+// Reads a record from disk
+func (h *historyStore) read(id string) (*gameRecord, error) {
+	data, err := ioutil.ReadFile(filepath.Join(h.Dir, "games", id+".json"))
+	if err != nil {
+		return nil, err
+	}
+	record := new(gameRecord)
+	if err := json.Unmarshal(data, record); err != nil {
+		return nil, err
+	}
+	return record, nil
+}
+
+// Method List returns a page of games, newest first, and the total number of games.
+// If player isn't empty only games with that player are included.
+func (h *historyStore) List(player string, offset int, limit int) ([]*gameRecord, int, error) {
+	h.Lock()
+	ids := make([]string, 0)
+	total := 0
+	for i := len(h.entries) - 1; i >= 0; i-- {
+		if player != "" && !hasPlayer(h.entries[i].Players, player) {
+			continue
+		}
+		if total >= offset && len(ids) < limit {
+			ids = append(ids, h.entries[i].Id)
+		}
+		total++
+	}
+	h.Unlock()
+
+	out := make([]*gameRecord, 0, len(ids))
+	for _, id := range ids {
+		record, err := h.read(id)
+		if err != nil {
+			return nil, 0, err
+		}
+		out = append(out, record)
+	}
+	return out, total, nil
+}
+
+func hasPlayer(players []string, player string) bool {
+	for _, name := range players {
+		if name == player {
+			return true
+		}
+	}
+	return false
+}
+
+// Writes to a temporary file first so a crash can't leave a half-written file
+func writeFileAtomic(path string, data []byte) error {
+	tmp := path + ".tmp"
+	if err := ioutil.WriteFile(tmp, data, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+const (
+	defaultPageSize = 20
+	maxPageSize     = 100
+)
+
+// Reads ?offset= and ?limit= from a request
+func pageParams(r *http.Request) (offset int, limit int) {
+	offset, _ = strconv.Atoi(r.URL.Query().Get("offset"))
+	if offset < 0 {
+		offset = 0
+	}
+	limit, err := strconv.Atoi(r.URL.Query().Get("limit"))
+	if err != nil || limit <= 0 {
+		limit = defaultPageSize
+	}
+	if limit > maxPageSize {
+		limit = maxPageSize
+	}
+	return offset, limit
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	data, err := json.Marshal(v)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	w.Write(data)
+}
+
+func writePage(w http.ResponseWriter, r *http.Request, player string) {
+	offset, limit := pageParams(r)
+	records, total, err := history.List(player, offset, limit)
+	if err != nil {
+		writeJSON(w, http.StatusInternalServerError, map[string]string{"error": err.Error()})
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"games":  records,
+		"total":  total,
+		"offset": offset,
+		"limit":  limit,
+	})
+}
+
+// Serves /api/games and /api/games/<id>
+func handleApiGames(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeJSON(w, http.StatusMethodNotAllowed, map[string]string{"error": "method not allowed"})
+		return
+	}
+	if history == nil {
+		writeJSON(w, http.StatusNotFound, map[string]string{"error": "history is disabled"})
+		return
+	}
+
+	id := strings.Trim(strings.TrimPrefix(r.URL.Path, "/api/games"), "/")
+	if id == "" {
+		writePage(w, r, "")
+		return
+	}
+	record, err := history.Get(id)
+	if err != nil {
+		writeJSON(w, http.StatusInternalServerError, map[string]string{"error": err.Error()})
+		return
+	}
+	if record == nil {
+		writeJSON(w, http.StatusNotFound, map[string]string{"error": "game not found"})
+		return
+	}
+	writeJSON(w, http.StatusOK, record)
+}
+
+// Serves /api/players/<name>/games
+func handleApiPlayers(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeJSON(w, http.StatusMethodNotAllowed, map[string]string{"error": "method not allowed"})
+		return
+	}
+	if history == nil {
+		writeJSON(w, http.StatusNotFound, map[string]string{"error": "history is disabled"})
+		return
+	}
+
+	parts := strings.Split(strings.Trim(strings.TrimPrefix(r.URL.Path, "/api/players"), "/"), "/")
+	if len(parts) != 2 || parts[0] == "" || parts[1] != "games" {
+		writeJSON(w, http.StatusNotFound, map[string]string{"error": "not found"})
+		return
+	}
+	writePage(w, r, parts[0])
+}
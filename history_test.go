@@ -0,0 +1,176 @@
+// countries.io
+// Copyright (C) 2019 Allen B
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program. If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"testing"
+	"time"
+)
+
+// Writes updates to a game's stream and closes it
+func writeUpdates(t *testing.T, h *historyStore, id string, count int, updates ...string) *replayStream {
+	t.Helper()
+	stream, err := h.Stream(id, count)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, update := range updates {
+		if err := stream.Add([]byte(update)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := stream.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return stream
+}
+
+// Saves a game, then reads its replay back and returns the updates in it
+func saveAndReadReplay(t *testing.T, h *historyStore, stream *replayStream, id string) []string {
+	t.Helper()
+	record := &gameRecord{Id: id, Players: []string{"a", "b"}, End: time.Now()}
+	rep := &replay{Players: record.Players, Width: 10, Height: 10, Topology: "square", Tick: 250}
+	if err := h.Save(record, rep, stream); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(stream.Path); !os.IsNotExist(err) {
+		t.Errorf("the stream of %s is still there", id)
+	}
+
+	data, err := ioutil.ReadFile(filepath.Join(h.Dir, record.Replay))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var saved replay
+	if err := json.Unmarshal(data, &saved); err != nil {
+		t.Fatalf("the replay of %s isn't JSON: %v", id, err)
+	}
+	if saved.Width != 10 || saved.Topology != "square" || !reflect.DeepEqual(saved.Players, rep.Players) {
+		t.Errorf("the replay of %s has the wrong settings: %+v", id, saved)
+	}
+	updates := make([]string, 0)
+	for _, update := range saved.Updates {
+		updates = append(updates, string(update))
+	}
+	return updates
+}
+
+func TestReplayStream(t *testing.T) {
+	h, err := openHistory(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// A game that resumes from a snapshot taken after 3 updates throws away the ones after
+	writeUpdates(t, h, "resumed", 0, `{"turn":0}`, `{"turn":1}`, `{"turn":2}`, `{"turn":3}`, `{"turn":4}`)
+	stream := writeUpdates(t, h, "resumed", 3, `{"turn":9}`)
+	if stream.Count != 4 {
+		t.Errorf("the stream counts %d updates, want 4", stream.Count)
+	}
+	got := saveAndReadReplay(t, h, stream, "resumed")
+	if want := []string{`{"turn":0}`, `{"turn":1}`, `{"turn":2}`, `{"turn":9}`}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got updates %v, want %v", got, want)
+	}
+
+	// A stream that's shorter than the snapshot says is kept whole, without a half-written update
+	path := filepath.Join(h.Dir, "replays", "short.updates")
+	if err := ioutil.WriteFile(path, []byte("{\"turn\":0}\n{\"turn\":1}\n{\"tu"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	stream = writeUpdates(t, h, "short", 5)
+	if stream.Count != 2 {
+		t.Errorf("the short stream counts %d updates, want 2", stream.Count)
+	}
+	got = saveAndReadReplay(t, h, stream, "short")
+	if want := []string{`{"turn":0}`, `{"turn":1}`}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got updates %v, want %v", got, want)
+	}
+
+	// A game with no updates still has a valid replay
+	stream = writeUpdates(t, h, "empty", 0)
+	if got := saveAndReadReplay(t, h, stream, "empty"); len(got) != 0 {
+		t.Errorf("got updates %v, want none", got)
+	}
+}
+
+func TestHistoryList(t *testing.T) {
+	dir := t.TempDir()
+	h, err := openHistory(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	start := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	for i := 0; i < 5; i++ {
+		players := []string{"alice", "bob"}
+		if i%2 == 1 {
+			players = []string{"alice", "carol"}
+		}
+		record := &gameRecord{Id: "game" + strconv.Itoa(i), Players: players, End: start.Add(time.Duration(i) * time.Hour)}
+		stream := writeUpdates(t, h, record.Id, 0, `{}`)
+		if err := h.Save(record, &replay{Players: players}, stream); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// The records are read back from disk after a restart too
+	reopened, err := openHistory(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, store := range []*historyStore{h, reopened} {
+		tests := []struct {
+			player        string
+			offset, limit int
+			want          []string
+			total         int
+		}{
+			{"", 0, 20, []string{"game4", "game3", "game2", "game1", "game0"}, 5},
+			{"", 1, 2, []string{"game3", "game2"}, 5},
+			{"", 10, 2, []string{}, 5},
+			{"bob", 0, 20, []string{"game4", "game2", "game0"}, 3},
+			{"carol", 1, 20, []string{"game1"}, 2},
+			{"dave", 0, 20, []string{}, 0},
+		}
+		for _, test := range tests {
+			records, total, err := store.List(test.player, test.offset, test.limit)
+			if err != nil {
+				t.Fatal(err)
+			}
+			ids := make([]string, 0)
+			for _, record := range records {
+				ids = append(ids, record.Id)
+			}
+			if !reflect.DeepEqual(ids, test.want) || total != test.total {
+				t.Errorf("List(%q, %d, %d) = %v, %d; want %v, %d", test.player, test.offset, test.limit, ids, total, test.want, test.total)
+			}
+		}
+
+		record, err := store.Get("game3")
+		if err != nil || record == nil || record.Players[1] != "carol" || !record.End.Equal(start.Add(3*time.Hour)) {
+			t.Errorf("Get(game3) = %+v, %v", record, err)
+		}
+		if record, err := store.Get("../game3"); record != nil || err != nil {
+			t.Errorf("Get(../game3) = %+v, %v; want nothing", record, err)
+		}
+	}
+}
@@ -0,0 +1,81 @@
+// countries.io
+// Copyright (C) 2019 Allen B
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program. If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+// The tile type of every tile is kept in Game.tileTypes so NextTurn doesn't
+// have to search for nearby capitals and cities. Whenever a tile changes owner
+// or gains or loses an urban building, the types of the tiles around it are
+// worked out again. Only tiles within the biggest suburb radius of the change
+// can be affected.
+
+// How far a change to a tile can change the types of other tiles
+var tileTypeRadius = maxSuburbRadius()
+
+func maxSuburbRadius() int {
+	radius := 0
+	for _, kind := range buildingKinds {
+		if kind.SuburbRadius > radius {
+			radius = kind.SuburbRadius
+		}
+	}
+	return radius
+}
+
+// Method setTerrain changes who owns a tile
+func (g *Game) setTerrain(tile int, country int) {
+	if g.Terrain[tile] == country {
+		return
+	}
+	g.countTile(tile, -1)
+	g.Terrain[tile] = country
+	g.countTile(tile, 1)
+	g.updateTileTypes(tile)
+}
+
+// Works out the types of the tiles around a tile that changed
+func (g *Game) updateTileTypes(tile int) {
+	for _, tileAround := range g.TilesAround(tile, tileTypeRadius) {
+		g.tileTypes[tileAround] = g.findTileType(tileAround)
+	}
+}
+
+// Method rebuildTileTypes works out the type of every tile from scratch
+func (g *Game) rebuildTileTypes() {
+	g.tileTypes = make([]int, len(g.Terrain))
+	for tile := range g.Terrain {
+		g.tileTypes[tile] = g.findTileType(tile)
+	}
+}
+
+// Works out the type of a tile by looking at the capitals and cities around it
+func (g *Game) findTileType(tile int) int {
+	country := g.Terrain[tile]
+	if country < 0 {
+		return country
+	}
+	if g.kind(tile).Urban {
+		return TILE_URBAN
+	}
+	for r := 1; r <= tileTypeRadius; r++ {
+		for _, tileAround := range g.TilesAround(tile, r) {
+			if g.kind(tileAround).SuburbRadius == r && g.Terrain[tileAround] == country {
+				return TILE_SUBURB
+			}
+		}
+	}
+	return TILE_RURAL
+}
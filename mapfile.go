@@ -0,0 +1,491 @@
+// countries.io
+// Copyright (C) 2019 Allen B
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program. If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// The version of the map format written by the editor
+const mapVersion = 1
+
+const (
+	minMapSize = 5
+	maxMapSize = 100
+
+	// Largest map file the server accepts, in bytes
+	maxMapFileSize = 1 << 20
+
+	// Armies on a wall that doesn't say how strong it is
+	defaultWallArmy = 9999
+
+	// Spawns can't be closer than this to each other, so starting land doesn't overlap
+	minSpawnDistance = 5
+
+	// The farthest nearest enemy can be at most this many times as far as the closest one
+	maxSpawnRatio = 1.5
+
+	// Most maps kept. Once there are this many, maps can be replaced but not added.
+	maxMaps = 1000
+
+	// Each IP address can save mapSaveCount maps per mapSavePeriod
+	mapSaveCount  = 20
+	mapSavePeriod = time.Hour
+)
+
+// Type MapFile is a hand-made map.
+// Tiles are indexes into the map, row by row.
+type MapFile struct {
+	Version  int    `json:"version"`
+	Name     string `json:"name"`
+	Width    int    `json:"width"`
+	Height   int    `json:"height"`
+	Topology string `json:"topology"`
+
+	Walls  []mapTile `json:"walls"`
+	Cities []mapTile `json:"cities"` // neutral cities and their garrisons
+	Camps  []int     `json:"camps"`  // barbarian camps, used if barbarians are on
+
+	// Where capitals can start
+	Spawns []int `json:"spawns"`
+
+	// Groups of indexes into Spawns, one group per team in 2v2 games
+	Teams [][]int `json:"teams,omitempty"`
+}
+
+// A tile with armies on it
+type mapTile struct {
+	Tile int  `json:"tile"`
+	Army uint `json:"army"`
+}
+
+var mapNamePattern = regexp.MustCompile(`^[a-z0-9_-]{1,32}$`)
+
+// Function parseMapFile reads and validates a map
+func parseMapFile(data []byte) (*MapFile, error) {
+	m := new(MapFile)
+	if err := json.Unmarshal(data, m); err != nil {
+		return nil, err
+	}
+	if err := m.Validate(); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// Method Validate checks that a map is well-formed, that every spawn can reach
+// every other one without breaking walls and that no spawn is much closer to
+// its nearest enemy than the others are
+func (m *MapFile) Validate() error {
+	if m.Version != mapVersion {
+		return fmt.Errorf("unsupported map version %d", m.Version)
+	}
+	if !mapNamePattern.MatchString(m.Name) {
+		return errors.New("map names can only have lowercase letters, digits, - and _")
+	}
+	if m.Width < minMapSize || m.Height < minMapSize || m.Width > maxMapSize || m.Height > maxMapSize {
+		return fmt.Errorf("maps must be between %d and %d tiles wide and high", minMapSize, maxMapSize)
+	}
+	topology, ok := topologies[m.Topology]
+	if !ok {
+		return errors.New("unknown map type " + m.Topology)
+	}
+
+	size := m.Width * m.Height
+	used := make(map[int]string)
+	use := func(tile int, what string) error {
+		if tile < 0 || tile >= size {
+			return fmt.Errorf("%s at %d is off the map", what, tile)
+		}
+		if other, ok := used[tile]; ok {
+			return fmt.Errorf("%s at %d is on top of a %s", what, tile, other)
+		}
+		used[tile] = what
+		return nil
+	}
+	walls := make(map[int]bool)
+	for _, wall := range m.Walls {
+		if err := use(wall.Tile, "wall"); err != nil {
+			return err
+		}
+		walls[wall.Tile] = true
+	}
+	for _, city := range m.Cities {
+		if err := use(city.Tile, "city"); err != nil {
+			return err
+		}
+	}
+	for _, camp := range m.Camps {
+		if err := use(camp, "camp"); err != nil {
+			return err
+		}
+	}
+	for _, spawn := range m.Spawns {
+		if err := use(spawn, "spawn"); err != nil {
+			return err
+		}
+	}
+
+	for _, camp := range m.Camps {
+		// Camps take the land around them
+		for _, tile := range topology.TilesAround(m.Width, m.Height, camp, 1) {
+			if tile != camp && used[tile] != "" {
+				return fmt.Errorf("camp at %d is too close to the %s at %d", camp, used[tile], tile)
+			}
+		}
+	}
+	if len(m.Spawns) < 2 {
+		return errors.New("maps need at least 2 spawns")
+	}
+	for i, spawn := range m.Spawns {
+		for _, tile := range topology.TilesAround(m.Width, m.Height, spawn, minSpawnDistance-1) {
+			if tile != spawn && used[tile] == "spawn" {
+				return fmt.Errorf("spawns at %d and %d are too close", spawn, tile)
+			}
+		}
+		// Starting land would cover these
+		for _, tile := range topology.TilesAround(m.Width, m.Height, spawn, 2) {
+			if used[tile] == "city" || used[tile] == "camp" {
+				return fmt.Errorf("spawn %d is too close to the %s at %d", i, used[tile], tile)
+			}
+		}
+	}
+
+	team := make([]int, len(m.Spawns))
+	if len(m.Teams) > 0 {
+		if len(m.Teams) < 2 {
+			return errors.New("maps with teams need at least 2 teams")
+		}
+		for i := range team {
+			team[i] = -1
+		}
+		for t, spawns := range m.Teams {
+			if len(spawns) == 0 || len(spawns) != len(m.Teams[0]) {
+				return errors.New("all teams need the same number of spawns, and at least one")
+			}
+			for _, spawn := range spawns {
+				if spawn < 0 || spawn >= len(m.Spawns) || team[spawn] >= 0 {
+					return fmt.Errorf("team %d has a bad spawn %d", t, spawn)
+				}
+				team[spawn] = t
+			}
+		}
+	} else {
+		for i := range team {
+			team[i] = i
+		}
+	}
+
+	// Nearest enemy spawn for each spawn
+	nearest := make([]int, len(m.Spawns))
+	for i, spawn := range m.Spawns {
+		distances := distancesFrom(topology, m.Width, m.Height, spawn, walls)
+		nearest[i] = -1
+		for j, other := range m.Spawns {
+			if distances[other] < 0 {
+				return fmt.Errorf("spawn %d can't reach spawn %d", i, j)
+			}
+			if team[i] != team[j] && team[j] >= 0 && (nearest[i] < 0 || distances[other] < nearest[i]) {
+				nearest[i] = distances[other]
+			}
+		}
+	}
+	closest, farthest := -1, -1
+	for i, distance := range nearest {
+		if team[i] < 0 {
+			continue // not in a team, only used outside of 2v2
+		}
+		if closest < 0 || distance < nearest[closest] {
+			closest = i
+		}
+		if farthest < 0 || distance > nearest[farthest] {
+			farthest = i
+		}
+	}
+	if float64(nearest[farthest]) > maxSpawnRatio*float64(nearest[closest]) {
+		return fmt.Errorf("spawns aren't fair: spawn %d is %d tiles from an enemy but spawn %d is %d",
+			closest, nearest[closest], farthest, nearest[farthest])
+	}
+	return nil
+}
+
+// Method Game creates a game on this map. Camps aren't placed, see PlaceCamps.
+// In 2v2 games on maps with teams, the countries i and i^1 share a team.
+func (m *MapFile) Game(countries []string, is2v2 bool, seed int64) (*Game, error) {
+	if len(countries) > len(m.Spawns) {
+		return nil, fmt.Errorf("map %s only has room for %d players", m.Name, len(m.Spawns))
+	}
+	g := newEmptyGame(countries, m.Width, m.Height, topologies[m.Topology], is2v2, seed)
+
+	for _, wall := range m.Walls {
+		g.setTerrain(wall.Tile, TILE_WALL)
+		g.setArmies(wall.Tile, wall.Army)
+		if wall.Army == 0 {
+			g.setArmies(wall.Tile, defaultWallArmy)
+		}
+	}
+	for _, city := range m.Cities {
+		g.setBuilding(city.Tile, BUILDING_CITY)
+		g.setArmies(city.Tile, city.Army)
+	}
+
+	var spawns []int
+	if is2v2 && len(m.Teams) > 0 {
+		if len(countries) > 2*len(m.Teams) || len(m.Teams[0]) < 2 {
+			return nil, fmt.Errorf("map %s doesn't have teams of 2", m.Name)
+		}
+		teams := g.random.Perm(len(m.Teams))
+		for country := range countries {
+			team := m.Teams[teams[country/2]]
+			spawns = append(spawns, m.Spawns[team[country%2]])
+		}
+	} else {
+		for _, i := range g.random.Perm(len(m.Spawns))[:len(countries)] {
+			spawns = append(spawns, m.Spawns[i])
+		}
+	}
+	for country, spawn := range spawns {
+		g.placeCapital(country, spawn)
+	}
+	return g, nil
+}
+
+// Method PlaceCamps puts the map's barbarian camps on a game
+func (m *MapFile) PlaceCamps(g *Game) {
+	for _, camp := range m.Camps {
+		g.placeCamp(camp)
+	}
+}
+
+// Type mapStore keeps hand-made maps on disk, one file per map in Dir.
+// It keeps at most Max maps.
+type mapStore struct {
+	Dir string
+	Max int
+	sync.Mutex
+}
+
+// The saved maps. nil if custom maps are disabled.
+var maps *mapStore
+
+// Function openMaps opens the maps in a directory
+func openMaps(dir string) (*mapStore, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	return &mapStore{Dir: dir, Max: maxMaps}, nil
+}
+
+// Method Get loads a map by name
+func (s *mapStore) Get(name string) (*MapFile, error) {
+	if !mapNamePattern.MatchString(name) {
+		return nil, errors.New("map not found")
+	}
+	s.Lock()
+	defer s.Unlock()
+	data, err := ioutil.ReadFile(filepath.Join(s.Dir, name+".json"))
+	if os.IsNotExist(err) {
+		return nil, errors.New("map not found")
+	}
+	if err != nil {
+		return nil, err
+	}
+	return parseMapFile(data)
+}
+
+// Returned when saving over a map without its owner's token
+var errMapTaken = errors.New("a map with that name already exists")
+
+// Returned when saving a new map while there are Max maps
+var errTooManyMaps = errors.New("there are too many maps, replace one of yours instead")
+
+// Method Save writes a map to disk. A new map gets a random owner token, which
+// is returned; replacing an existing map needs that token.
+func (s *mapStore) Save(m *MapFile, token string) (string, error) {
+	data, err := json.Marshal(m)
+	if err != nil {
+		return "", err
+	}
+	s.Lock()
+	defer s.Unlock()
+
+	ownerPath := filepath.Join(s.Dir, m.Name+".owner")
+	owner, err := ioutil.ReadFile(ownerPath)
+	switch {
+	case err == nil:
+		sum := sha256.Sum256([]byte(token))
+		if token == "" || subtle.ConstantTimeCompare(owner, []byte(hex.EncodeToString(sum[:]))) != 1 {
+			return "", errMapTaken
+		}
+	case !os.IsNotExist(err):
+		return "", err
+	default:
+		// Maps from before owners were kept can't be replaced
+		if _, err := os.Stat(filepath.Join(s.Dir, m.Name+".json")); err == nil {
+			return "", errMapTaken
+		}
+		names, err := s.names()
+		if err != nil {
+			return "", err
+		}
+		if len(names) >= s.Max {
+			return "", errTooManyMaps
+		}
+		token, err = newToken()
+		if err != nil {
+			return "", err
+		}
+		sum := sha256.Sum256([]byte(token))
+		if err := writeFileAtomic(ownerPath, []byte(hex.EncodeToString(sum[:]))); err != nil {
+			return "", err
+		}
+	}
+	return token, writeFileAtomic(filepath.Join(s.Dir, m.Name+".json"), data)
+}
+
+// Function newToken returns a random string that's hard to guess
+func newToken() (string, error) {
+	data := make([]byte, 16)
+	if _, err := rand.Read(data); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(data), nil
+}
+
+// Method List returns the names of all maps, sorted
+func (s *mapStore) List() ([]string, error) {
+	s.Lock()
+	defer s.Unlock()
+	return s.names()
+}
+
+// Returns the names of all maps, sorted. It must be called with s locked.
+func (s *mapStore) names() ([]string, error) {
+	files, err := ioutil.ReadDir(s.Dir)
+	if err != nil {
+		return nil, err
+	}
+	names := make([]string, 0)
+	for _, file := range files {
+		name := strings.TrimSuffix(file.Name(), ".json")
+		if name != file.Name() && mapNamePattern.MatchString(name) {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+// The map saves of each IP address
+var mapSaveLimiters = struct {
+	Map map[string]*rateLimiter
+	sync.Mutex
+}{
+	Map: make(map[string]*rateLimiter),
+}
+
+// Function allowMapSave records a map save from an IP address and returns false if
+// it saved too many lately
+func allowMapSave(ip string) bool {
+	mapSaveLimiters.Lock()
+	defer mapSaveLimiters.Unlock()
+	for other, limiter := range mapSaveLimiters.Map {
+		if other != ip && limiter.Idle() {
+			delete(mapSaveLimiters.Map, other)
+		}
+	}
+	limiter, ok := mapSaveLimiters.Map[ip]
+	if !ok {
+		limiter = &rateLimiter{Count: mapSaveCount, Period: mapSavePeriod}
+		mapSaveLimiters.Map[ip] = limiter
+	}
+	return limiter.Allow()
+}
+
+// Serves /api/maps, and /api/maps/<name> which can be saved to with POST.
+// Saving over a map needs the X-Map-Token header the first save returned.
+func handleApiMaps(w http.ResponseWriter, r *http.Request) {
+	if maps == nil {
+		writeJSON(w, http.StatusNotFound, map[string]string{"error": "custom maps are disabled"})
+		return
+	}
+
+	name := strings.Trim(strings.TrimPrefix(r.URL.Path, "/api/maps"), "/")
+	switch {
+	case r.Method == http.MethodGet && name == "":
+		names, err := maps.List()
+		if err != nil {
+			writeJSON(w, http.StatusInternalServerError, map[string]string{"error": err.Error()})
+			return
+		}
+		writeJSON(w, http.StatusOK, map[string]interface{}{"maps": names})
+	case r.Method == http.MethodGet:
+		m, err := maps.Get(name)
+		if err != nil {
+			writeJSON(w, http.StatusNotFound, map[string]string{"error": err.Error()})
+			return
+		}
+		writeJSON(w, http.StatusOK, m)
+	case r.Method == http.MethodPost && name != "":
+		if !allowMapSave(clientIP(r)) {
+			writeJSON(w, http.StatusTooManyRequests, map[string]string{"error": "too many maps saved, try again later"})
+			return
+		}
+		data, err := ioutil.ReadAll(http.MaxBytesReader(w, r.Body, maxMapFileSize))
+		if err != nil {
+			writeJSON(w, http.StatusRequestEntityTooLarge, map[string]string{"error": "map is too big"})
+			return
+		}
+		m, err := parseMapFile(data)
+		if err != nil {
+			writeJSON(w, http.StatusBadRequest, map[string]string{"error": err.Error()})
+			return
+		}
+		if m.Name != name {
+			writeJSON(w, http.StatusBadRequest, map[string]string{"error": "map name doesn't match the url"})
+			return
+		}
+		token, err := maps.Save(m, r.Header.Get("X-Map-Token"))
+		if err == errMapTaken || err == errTooManyMaps {
+			writeJSON(w, http.StatusConflict, map[string]string{"error": err.Error()})
+			return
+		}
+		if err != nil {
+			writeJSON(w, http.StatusInternalServerError, map[string]string{"error": err.Error()})
+			return
+		}
+		w.Header().Set("X-Map-Token", token)
+		writeJSON(w, http.StatusOK, m)
+	default:
+		writeJSON(w, http.StatusMethodNotAllowed, map[string]string{"error": "method not allowed"})
+	}
+}
@@ -0,0 +1,160 @@
+// countries.io
+// Copyright (C) 2019 Allen B
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program. If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// Returns a fair 20x20 map with a spawn in two opposite corners
+func testMap() *MapFile {
+	return &MapFile{
+		Version:  mapVersion,
+		Name:     "test",
+		Width:    20,
+		Height:   20,
+		Topology: "square",
+		Spawns:   []int{2*20 + 2, 17*20 + 17},
+	}
+}
+
+func TestMapFileValidate(t *testing.T) {
+	tests := []struct {
+		name   string
+		change func(m *MapFile)
+		err    string // part of the error, empty if the map is fine
+	}{
+		{"fine", func(m *MapFile) {}, ""},
+		{"wall with a gap", func(m *MapFile) {
+			for row := 1; row < 20; row++ {
+				m.Walls = append(m.Walls, mapTile{Tile: row*20 + 10})
+			}
+		}, ""},
+		{"disconnected", func(m *MapFile) {
+			for row := 0; row < 20; row++ {
+				m.Walls = append(m.Walls, mapTile{Tile: row*20 + 10})
+			}
+		}, "can't reach"},
+		{"unfair spawns", func(m *MapFile) {
+			m.Spawns = []int{2*20 + 2, 2*20 + 8, 17*20 + 17}
+		}, "aren't fair"},
+		{"spawns too close", func(m *MapFile) {
+			m.Spawns = []int{2*20 + 2, 2*20 + 4, 17*20 + 17}
+		}, "too close"},
+		{"one spawn", func(m *MapFile) { m.Spawns = m.Spawns[:1] }, "at least 2 spawns"},
+		{"too wide", func(m *MapFile) { m.Width = maxMapSize + 1 }, "between"},
+		{"too high", func(m *MapFile) { m.Height = maxMapSize + 1 }, "between"},
+		{"too small", func(m *MapFile) { m.Width = minMapSize - 1 }, "between"},
+		{"huge", func(m *MapFile) { m.Width, m.Height = 1<<20, 1<<20 }, "between"},
+		{"spawn off the map", func(m *MapFile) { m.Spawns[1] = 400 }, "off the map"},
+		{"city on a spawn", func(m *MapFile) {
+			m.Cities = []mapTile{{Tile: m.Spawns[0], Army: 10}}
+		}, "on top of"},
+		{"city by a spawn", func(m *MapFile) {
+			m.Cities = []mapTile{{Tile: 3*20 + 3, Army: 10}}
+		}, "too close"},
+		{"unknown topology", func(m *MapFile) { m.Topology = "sphere" }, "unknown map type"},
+		{"bad name", func(m *MapFile) { m.Name = "../test" }, "map names"},
+		{"old version", func(m *MapFile) { m.Version = 0 }, "version"},
+		{"uneven teams", func(m *MapFile) {
+			m.Spawns = []int{2*20 + 2, 2*20 + 17, 17*20 + 2}
+			m.Teams = [][]int{{0, 1}, {2}}
+		}, "same number"},
+	}
+	for _, test := range tests {
+		m := testMap()
+		test.change(m)
+		err := m.Validate()
+		switch {
+		case test.err == "" && err != nil:
+			t.Errorf("%s: %v", test.name, err)
+		case test.err != "" && err == nil:
+			t.Errorf("%s: the map was accepted", test.name)
+		case test.err != "" && !strings.Contains(err.Error(), test.err):
+			t.Errorf("%s: got %q, want an error about %q", test.name, err, test.err)
+		}
+	}
+}
+
+func TestMapStoreMax(t *testing.T) {
+	store, err := openMaps(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	store.Max = 2
+
+	tokens := make(map[string]string)
+	for _, name := range []string{"a", "b"} {
+		m := testMap()
+		m.Name = name
+		if tokens[name], err = store.Save(m, ""); err != nil {
+			t.Fatal(err)
+		}
+	}
+	m := testMap()
+	m.Name = "c"
+	if _, err := store.Save(m, ""); err != errTooManyMaps {
+		t.Errorf("saving a third map: got %v, want %v", err, errTooManyMaps)
+	}
+	m.Name = "a"
+	if _, err := store.Save(m, tokens["a"]); err != nil {
+		t.Errorf("replacing a map: %v", err)
+	}
+	if _, err := store.Save(m, tokens["b"]); err != errMapTaken {
+		t.Errorf("replacing a map with another map's token: got %v, want %v", err, errMapTaken)
+	}
+}
+
+func TestMapSaveRateLimit(t *testing.T) {
+	store, err := openMaps(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func(old *mapStore) { maps = old }(maps)
+	maps = store
+
+	save := func(ip string, name string) int {
+		m := testMap()
+		m.Name = name
+		data, err := json.Marshal(m)
+		if err != nil {
+			t.Fatal(err)
+		}
+		r := httptest.NewRequest(http.MethodPost, "/api/maps/"+name, bytes.NewReader(data))
+		r.RemoteAddr = ip + ":1234"
+		w := httptest.NewRecorder()
+		handleApiMaps(w, r)
+		return w.Code
+	}
+	for i := 0; i < mapSaveCount; i++ {
+		if code := save("192.0.2.1", "map"+strconv.Itoa(i)); code != http.StatusOK {
+			t.Fatalf("save %d: status %d", i, code)
+		}
+	}
+	if code := save("192.0.2.1", "onemore"); code != http.StatusTooManyRequests {
+		t.Errorf("save over the limit: status %d, want %d", code, http.StatusTooManyRequests)
+	}
+	if code := save("192.0.2.2", "onemore"); code != http.StatusOK {
+		t.Errorf("save from another address: status %d", code)
+	}
+}
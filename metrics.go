@@ -0,0 +1,218 @@
+// countries.io
+// Copyright (C) 2019 Allen B
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program. If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"sync/atomic"
+)
+
+// Type counterVec counts things by one label, like commands by name
+type counterVec struct {
+	Name  string
+	Help  string
+	Label string
+
+	values map[string]uint64
+	sync.Mutex
+}
+
+// Type gauge is a value that goes up and down
+type gauge struct {
+	Name  string
+	Help  string
+	value int64
+}
+
+// Type histogram counts how many values fall under each bucket
+type histogram struct {
+	Name    string
+	Help    string
+	Buckets []float64 // upper bounds, ascending
+
+	counts []uint64 // count = [bucket], not cumulative
+	sum    float64
+	count  uint64
+	sync.Mutex
+}
+
+func newCounterVec(name string, help string, label string) *counterVec {
+	return &counterVec{Name: name, Help: help, Label: label, values: make(map[string]uint64)}
+}
+
+func newHistogram(name string, help string, buckets []float64) *histogram {
+	return &histogram{Name: name, Help: help, Buckets: buckets, counts: make([]uint64, len(buckets))}
+}
+
+// Method Inc adds one to the count of a label value
+func (c *counterVec) Inc(value string) {
+	c.Lock()
+	c.values[value]++
+	c.Unlock()
+}
+
+func (g *gauge) Add(delta int64) {
+	atomic.AddInt64(&g.value, delta)
+}
+
+func (g *gauge) Get() int64 {
+	return atomic.LoadInt64(&g.value)
+}
+
+// Method Observe records a value
+func (h *histogram) Observe(v float64) {
+	h.Lock()
+	defer h.Unlock()
+	h.sum += v
+	h.count++
+	for i, bound := range h.Buckets {
+		if v <= bound {
+			h.counts[i]++
+			return
+		}
+	}
+}
+
+func (c *counterVec) write(w io.Writer) {
+	c.Lock()
+	defer c.Unlock()
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s counter\n", c.Name, c.Help, c.Name)
+	values := make([]string, 0, len(c.values))
+	for value := range c.values {
+		values = append(values, value)
+	}
+	sort.Strings(values)
+	for _, value := range values {
+		fmt.Fprintf(w, "%s{%s=%s} %d\n", c.Name, c.Label, strconv.Quote(value), c.values[value])
+	}
+}
+
+func writeGauge(w io.Writer, name string, help string, value int64) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s gauge\n%s %d\n", name, help, name, name, value)
+}
+
+func (h *histogram) write(w io.Writer) {
+	h.Lock()
+	defer h.Unlock()
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s histogram\n", h.Name, h.Help, h.Name)
+	cumulative := uint64(0)
+	for i, bound := range h.Buckets {
+		cumulative += h.counts[i]
+		fmt.Fprintf(w, "%s_bucket{le=\"%s\"} %d\n", h.Name, strconv.FormatFloat(bound, 'g', -1, 64), cumulative)
+	}
+	fmt.Fprintf(w, "%s_bucket{le=\"+Inf\"} %d\n", h.Name, h.count)
+	fmt.Fprintf(w, "%s_sum %s\n", h.Name, strconv.FormatFloat(h.sum, 'g', -1, 64))
+	fmt.Fprintf(w, "%s_count %d\n", h.Name, h.count)
+}
+
+// Commands that are counted by name. Anything else is counted as "other"
+// so clients can't make up new label values.
+var gameCommandNames = map[string]bool{
+	"join": true, "attack": true, "city": true, "wall": true, "school": true, "portal": true,
+	"collect": true, "launcher": true, "relocate": true, "propose": true, "accept": true,
+	"decline": true, "break": true, "research": true, "pause": true, "unpause": true,
+	"chat": true, "chat_team": true, "surrender": true, "close": true,
+}
+var roomCommandNames = map[string]bool{
+	"join": true, "ping": true, "speed": true, "rule": true, "topology": true, "size": true,
+	"aspect": true, "map": true, "chat": true, "close": true,
+}
+
+func commandLabel(command string, known map[string]bool) string {
+	if known[command] {
+		return command
+	}
+	return "other"
+}
+
+// What the server measures about itself
+var metrics = struct {
+	Games *gauge
+
+	GameCommands    *counterVec
+	RoomCommands    *counterVec
+	Actions         *counterVec
+	RejectedActions *counterVec
+	DroppedCommands *counterVec
+
+	TickDuration      *histogram
+	BroadcastDuration *histogram
+	MessageSize       *histogram
+}{
+	Games: &gauge{},
+
+	GameCommands:    newCounterVec("countries_game_commands_total", "Commands received from players in games.", "command"),
+	RoomCommands:    newCounterVec("countries_room_commands_total", "Commands received from players in rooms.", "command"),
+	Actions:         newCounterVec("countries_actions_total", "Actions handled by game threads.", "action"),
+	RejectedActions: newCounterVec("countries_actions_rejected_total", "Actions game threads turned down, like attacks from tiles the player doesn't own.", "action"),
+	DroppedCommands: newCounterVec("countries_dropped_commands_total", "Commands dropped before reaching a game: over the rate limit, invalid, or with the game's queue full.", "reason"),
+
+	TickDuration: newHistogram("countries_tick_duration_seconds", "Time a game thread takes to handle a tick, without sending the update.",
+		[]float64{0.0005, 0.001, 0.0025, 0.005, 0.01, 0.025, 0.05, 0.1, 0.25}),
+	BroadcastDuration: newHistogram("countries_broadcast_duration_seconds", "Time it takes to send a message to everyone in a game.",
+		[]float64{0.0001, 0.00025, 0.0005, 0.001, 0.0025, 0.005, 0.01, 0.025, 0.1}),
+	MessageSize: newHistogram("countries_broadcast_message_bytes", "Size of the messages sent to everyone in a game.",
+		[]float64{64, 256, 1024, 4096, 16384, 65536, 262144, 1048576}),
+}
+
+// Counts an action handled by a game thread
+func countAction(action string, ok bool) {
+	metrics.Actions.Inc(action)
+	if !ok {
+		metrics.RejectedActions.Inc(action)
+	}
+}
+
+// Serves /metrics in the Prometheus text format
+func handleMetrics(w http.ResponseWriter, r *http.Request) {
+	roomConns.Lock()
+	activeRooms := 0
+	for _, room := range rooms {
+		if len(room.Countries) > 0 {
+			activeRooms++
+		}
+	}
+	roomSockets := len(roomConns.Map)
+	roomConns.Unlock()
+
+	gameConns.Lock()
+	gameSockets := len(gameConns.Map)
+	gameConns.Unlock()
+
+	var buf bytes.Buffer
+	writeGauge(&buf, "countries_rooms", "Rooms with players waiting in them.", int64(activeRooms))
+	writeGauge(&buf, "countries_games", "Games being played.", metrics.Games.Get())
+	writeGauge(&buf, "countries_room_connections", "Websockets connected to rooms.", int64(roomSockets))
+	writeGauge(&buf, "countries_game_connections", "Websockets connected to games.", int64(gameSockets))
+	metrics.GameCommands.write(&buf)
+	metrics.RoomCommands.write(&buf)
+	metrics.Actions.write(&buf)
+	metrics.RejectedActions.write(&buf)
+	metrics.DroppedCommands.write(&buf)
+	metrics.TickDuration.write(&buf)
+	metrics.BroadcastDuration.write(&buf)
+	metrics.MessageSize.write(&buf)
+
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	w.Write(buf.Bytes())
+}
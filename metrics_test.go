@@ -0,0 +1,88 @@
+// countries.io
+// Copyright (C) 2019 Allen B
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program. If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// Returns the value of a gauge at /metrics
+func readGauge(t *testing.T, name string) int {
+	recorder := httptest.NewRecorder()
+	handleMetrics(recorder, httptest.NewRequest("GET", "/metrics", nil))
+	match := regexp.MustCompile(`(?m)^` + name + ` (\d+)$`).FindStringSubmatch(recorder.Body.String())
+	if match == nil {
+		t.Fatalf("%s isn't in /metrics", name)
+	}
+	value, _ := strconv.Atoi(match[1])
+	return value
+}
+
+// Waits for a gauge to get to a value
+func waitForGauge(t *testing.T, name string, want int) {
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		got := readGauge(t, name)
+		if got == want {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("%s is %d, want %d", name, got, want)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestGameConnectionsGaugeGoesDown(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := gameUpgrader.Upgrade(w, r, nil)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		// Join as a spectator of a game that isn't running
+		gameConns.Lock()
+		gameConns.Map[conn] = gameConnInfo{Game: "gauge", Index: -1}
+		gameConns.Unlock()
+		readCommands(conn, gameCommandRate, &gameConns, handleGameCommand)
+	}))
+	defer server.Close()
+	url := "ws" + strings.TrimPrefix(server.URL, "http")
+
+	before := readGauge(t, "countries_game_connections")
+	for _, closeMessage := range []bool{true, false} {
+		conn, _, err := websocket.DefaultDialer.Dial(url, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		waitForGauge(t, "countries_game_connections", before+1)
+		if closeMessage {
+			conn.WriteMessage(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseGoingAway, ""))
+		}
+		// Without a close message the connection just drops
+		conn.Close()
+		waitForGauge(t, "countries_game_connections", before)
+	}
+}
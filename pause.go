@@ -0,0 +1,117 @@
+// countries.io
+// Copyright (C) 2019 Allen B
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program. If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"errors"
+	"time"
+)
+
+const (
+	// Number of times a player can vote to pause in a public game
+	pausesPerPlayer = 3
+
+	// Public games resume by themselves after this long
+	maxPauseLength = 2 * time.Minute
+)
+
+// Type pauseState keeps track of whether a game is paused
+type pauseState struct {
+	Paused bool
+	Since  time.Time
+
+	// Country index of the host of a custom room, or -1 in public games
+	Host int
+
+	Votes map[int]bool // hasVoted = [countryIndex]
+	Left  []int        // pausesLeft = [countryIndex]
+}
+
+func newPauseState(countries int, host int) *pauseState {
+	p := &pauseState{
+		Host:  host,
+		Votes: make(map[int]bool),
+		Left:  make([]int, countries),
+	}
+	for i := range p.Left {
+		p.Left[i] = pausesPerPlayer
+	}
+	return p
+}
+
+// Method clone returns a copy that doesn't change as the game goes on
+func (p *pauseState) clone() *pauseState {
+	c := *p
+	c.Votes = make(map[int]bool, len(p.Votes))
+	for country, voted := range p.Votes {
+		c.Votes[country] = voted
+	}
+	c.Left = append([]int(nil), p.Left...)
+	return &c
+}
+
+// Method Request handles a pause or unpause request by a country.
+// It returns true if the game was paused or unpaused as a result.
+func (p *pauseState) Request(g *Game, countryIndex int, pause bool) (bool, error) {
+	if g.Losers[countryIndex] {
+		return false, errors.New("you are out of the game")
+	}
+	if p.Paused == pause {
+		return false, nil
+	}
+
+	if p.Host >= 0 {
+		if countryIndex != p.Host {
+			return false, errors.New("only the host can pause")
+		}
+		p.set(pause)
+		return true, nil
+	}
+
+	if p.Votes[countryIndex] {
+		return false, nil
+	}
+	if pause {
+		if p.Left[countryIndex] <= 0 {
+			return false, errors.New("no pauses left")
+		}
+		p.Left[countryIndex]--
+	}
+	p.Votes[countryIndex] = true
+
+	if len(p.Votes) >= p.VotesNeeded(g) {
+		p.set(pause)
+		return true, nil
+	}
+	return false, nil
+}
+
+// Method VotesNeeded returns the number of votes needed to pause or unpause
+func (p *pauseState) VotesNeeded(g *Game) int {
+	return (len(g.Countries)-len(g.Losers))/2 + 1
+}
+
+// Method Expired returns true if a public game has been paused for too long
+func (p *pauseState) Expired() bool {
+	return p.Paused && p.Host < 0 && time.Since(p.Since) > maxPauseLength
+}
+
+func (p *pauseState) set(pause bool) {
+	p.Paused = pause
+	p.Since = time.Now()
+	p.Votes = make(map[int]bool)
+}
@@ -0,0 +1,103 @@
+// countries.io
+// Copyright (C) 2019 Allen B
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program. If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"encoding/json"
+)
+
+// Type Tech is a technology in the research tree
+type Tech struct {
+	Id       string   `json:"id"`
+	Name     string   `json:"name"`
+	Branch   string   `json:"branch"`
+	Cost     int      `json:"cost"` // research points
+	Requires []string `json:"requires"`
+}
+
+// The research tree. Countries make one research point per scientist per turn.
+var techTree = []Tech{
+	{Id: "granary", Name: "Granary", Branch: "economy", Cost: 2000, Requires: []string{}},
+	{Id: "taxes", Name: "Taxes", Branch: "economy", Cost: 5000, Requires: []string{"granary"}},
+
+	{Id: "walls", Name: "Walls", Branch: "defense", Cost: 4000, Requires: []string{}},
+	{Id: "launchers", Name: "Launchers", Branch: "defense", Cost: 10000, Requires: []string{"walls"}},
+
+	{Id: "collect", Name: "Collect", Branch: "mobility", Cost: 1000, Requires: []string{}},
+	{Id: "portals", Name: "Portals", Branch: "mobility", Cost: 20000, Requires: []string{"collect"}},
+}
+
+var techsById = func() map[string]*Tech {
+	out := make(map[string]*Tech)
+	for i := range techTree {
+		out[techTree[i].Id] = &techTree[i]
+	}
+	return out
+}()
+
+// Method HasTech returns true if a country has researched a tech
+func (g *Game) HasTech(countryIndex int, tech string) bool {
+	return g.Techs[countryIndex][tech]
+}
+
+// Method Research spends research points to unlock a tech
+func (g *Game) Research(countryIndex int, tech string) bool {
+	t, ok := techsById[tech]
+	if !ok || g.HasTech(countryIndex, tech) {
+		return false
+	}
+	for _, required := range t.Requires {
+		if !g.HasTech(countryIndex, required) {
+			return false
+		}
+	}
+	if g.ResearchPoints[countryIndex] < t.Cost {
+		return false
+	}
+	g.ResearchPoints[countryIndex] -= t.Cost
+	g.Techs[countryIndex][tech] = true
+	return true
+}
+
+// Adds each country's scientists to its research points
+func (g *Game) updateResearch() {
+	_, _, scientists := g.Totals()
+	for country, count := range scientists {
+		if !g.Losers[country] {
+			g.ResearchPoints[country] += int(count)
+		}
+	}
+}
+
+// Returns the techs of every country as lists
+func (g *Game) techLists() [][]string {
+	out := make([][]string, len(g.Countries))
+	for country, techs := range g.Techs {
+		out[country] = make([]string, 0, len(techs))
+		for _, tech := range techTree {
+			if techs[tech.Id] {
+				out[country] = append(out[country], tech.Id)
+			}
+		}
+	}
+	return out
+}
+
+// Function marshalTechTree creates json of the research tree
+func marshalTechTree() ([]byte, error) {
+	return json.Marshal(techTree)
+}
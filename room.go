@@ -17,17 +17,134 @@
 package main
 
 import (
+	"errors"
+	"math"
+	"math/rand"
+	"strconv"
+	"strings"
 	"time"
 )
 
+// Tick lengths of the game speed presets.
+// A turn is two ticks long.
+var speedPresets = map[string]time.Duration{
+	"slow":   400 * time.Millisecond,
+	"normal": 250 * time.Millisecond,
+	"fast":   150 * time.Millisecond,
+}
+
+const (
+	minTickLength = 50 * time.Millisecond
+	maxTickLength = 2000 * time.Millisecond
+)
+
+// The tick length used by rooms that don't set their own
+var defaultTickLength = speedPresets["normal"]
+
+// How long a room waits for more players once two have joined
+var lobbyCountdown = 2 * time.Minute
+
+// Function parseSpeed returns the tick length for a speed preset
+// or for a custom value in milliseconds
+func parseSpeed(speed string) (time.Duration, error) {
+	if tick, ok := speedPresets[speed]; ok {
+		return tick, nil
+	}
+	ms, err := strconv.Atoi(speed)
+	if err != nil {
+		return 0, errors.New("unknown speed " + speed)
+	}
+	tick := time.Duration(ms) * time.Millisecond
+	if tick < minTickLength || tick > maxTickLength {
+		return 0, errors.New("speed must be between " + minTickLength.String() + " and " + maxTickLength.String())
+	}
+	return tick, nil
+}
+
+// The most players a custom room can have
+const customRoomMax = 6
+
+// How much bigger or smaller than medium each map size is, per side
+var mapSizePresets = map[string]float64{
+	"small":  0.75,
+	"medium": 1,
+	"large":  1.25,
+}
+
+// Map shapes go from 1:3 to 3:1
+const maxAspectRatio = 3
+
+// Function parseAspect reads an aspect ratio like 16:9 and returns width / height
+func parseAspect(aspect string) (float64, error) {
+	parts := strings.Split(aspect, ":")
+	if len(parts) != 2 {
+		return 0, errors.New("aspect ratios look like 16:9")
+	}
+	w, err1 := strconv.Atoi(parts[0])
+	h, err2 := strconv.Atoi(parts[1])
+	if err1 != nil || err2 != nil || w <= 0 || h <= 0 {
+		return 0, errors.New("aspect ratios look like 16:9")
+	}
+	ratio := float64(w) / float64(h)
+	if ratio > maxAspectRatio || ratio < 1.0/maxAspectRatio {
+		return 0, errors.New("maps can't be more than 3 times wider than they are high, or the other way around")
+	}
+	return ratio, nil
+}
+
+// Function mapDimensions returns the width and height of a generated map.
+// A medium 1:1 map for n players is (n+1)*10 tiles on each side,
+// other shapes have about the same number of tiles.
+// Maps are never bigger than maxMapSize on either side.
+func mapDimensions(players int, size string, aspect float64) (int, int) {
+	side := float64(players+1) * 10 * mapSizePresets[size]
+	// Keep the shape when the map would be too big
+	side = math.Min(side, maxMapSize/math.Sqrt(aspect))
+	side = math.Min(side, maxMapSize*math.Sqrt(aspect))
+	width := int(math.Round(side * math.Sqrt(aspect)))
+	height := int(math.Round(side / math.Sqrt(aspect)))
+	return clampMapSize(width), clampMapSize(height)
+}
+
+func clampMapSize(n int) int {
+	if n < minMapSize {
+		return minMapSize
+	}
+	if n > maxMapSize {
+		return maxMapSize
+	}
+	return n
+}
+
 // Type Room represents a room
 type Room struct {
 	Max   int // Max # of people
 	Is2v2 bool
 
+	// Custom rooms can be configured by their host
+	Custom bool
+	Host   string
+
+	// Length of a game tick
+	Speed time.Duration
+
+	Rules Rules
+
+	Topology Topology
+
+	// Map size preset and aspect ratio, like 16:9
+	Size   string
+	Aspect string
+
+	// A hand-made map, nil to generate one
+	Map *MapFile
+
 	Countries map[string]bool
 
 	StartTime *time.Time
+
+	// Whether the room's game is being made
+	Starting bool
 }
 
 func NewRoom(max int, is2v2 bool) *Room {
@@ -35,6 +152,11 @@ func NewRoom(max int, is2v2 bool) *Room {
 		Max:       max,
 		Countries: make(map[string]bool),
 		Is2v2:     is2v2,
+		Speed:     defaultTickLength,
+		Rules:     defaultRules,
+		Topology:  squareTopology{},
+		Size:      "medium",
+		Aspect:    "1:1",
 	}
 
 	return r
@@ -49,9 +171,12 @@ func (r *Room) Add(name string) bool {
 		return false
 	}
 	r.Countries[name] = true
+	if r.Host == "" {
+		r.Host = name
+	}
 	if len(r.Countries) >= 2 && r.StartTime == nil && !r.Is2v2 {
 		r.StartTime = new(time.Time)
-		*r.StartTime = time.Now().Add(time.Duration(2 * time.Minute))
+		*r.StartTime = time.Now().Add(lobbyCountdown)
 	}
 	return true
 }
@@ -59,16 +184,141 @@ func (r *Room) Add(name string) bool {
 // Remove a player
 func (r *Room) Remove(name string) bool {
 	delete(r.Countries, name)
+	if r.Host == name {
+		r.Host = ""
+		for country, _ := range r.Countries {
+			r.Host = country
+			break
+		}
+	}
 	if len(r.Countries) <= 1 {
 		r.StartTime = nil
 	}
 	return true
 }
 
-func (r *Room) Game() *Game {
+// Method SetSpeed changes the game speed. Only the host of a custom room can do this.
+func (r *Room) SetSpeed(name string, speed string) error {
+	if !r.Custom || name != r.Host {
+		return errors.New("only the host can change the speed")
+	}
+	tick, err := parseSpeed(speed)
+	if err != nil {
+		return err
+	}
+	r.Speed = tick
+	return nil
+}
+
+// Method SetRule turns a rule on or off. Only the host of a custom room can do this.
+func (r *Room) SetRule(name string, rule string, on bool) error {
+	if !r.Custom || name != r.Host {
+		return errors.New("only the host can change the rules")
+	}
+	return r.Rules.Set(rule, on)
+}
+
+// Method SetTopology changes the shape of the map. Only the host of a custom room can do this.
+func (r *Room) SetTopology(name string, topology string) error {
+	if !r.Custom || name != r.Host {
+		return errors.New("only the host can change the map")
+	}
+	if r.Map != nil {
+		return errors.New("the map decides its own shape")
+	}
+	t, ok := topologies[topology]
+	if !ok {
+		return errors.New("unknown map type " + topology)
+	}
+	r.Topology = t
+	return nil
+}
+
+// Method SetSize changes the size of generated maps. Only the host of a custom room can do this.
+func (r *Room) SetSize(name string, size string) error {
+	if !r.Custom || name != r.Host {
+		return errors.New("only the host can change the map")
+	}
+	if r.Map != nil {
+		return errors.New("the map decides its own size")
+	}
+	if _, ok := mapSizePresets[size]; !ok {
+		return errors.New("unknown map size " + size)
+	}
+	r.Size = size
+	return nil
+}
+
+// Method SetAspect changes the shape of generated maps. Only the host of a custom room can do this.
+func (r *Room) SetAspect(name string, aspect string) error {
+	if !r.Custom || name != r.Host {
+		return errors.New("only the host can change the map")
+	}
+	if r.Map != nil {
+		return errors.New("the map decides its own size")
+	}
+	if _, err := parseAspect(aspect); err != nil {
+		return err
+	}
+	r.Aspect = aspect
+	return nil
+}
+
+// Method SetMap picks a hand-made map, or goes back to generated maps if name is empty.
+// Only the host of a custom room can do this.
+func (r *Room) SetMap(name string, mapName string) error {
+	if !r.Custom || name != r.Host {
+		return errors.New("only the host can change the map")
+	}
+	if mapName == "" {
+		r.Map = nil
+		r.Max = customRoomMax
+		return nil
+	}
+	if maps == nil {
+		return errors.New("custom maps are disabled")
+	}
+	m, err := maps.Get(mapName)
+	if err != nil {
+		return err
+	}
+	if len(m.Spawns) < len(r.Countries) {
+		return errors.New("that map doesn't have room for everyone here")
+	}
+	r.Map = m
+	r.Topology = topologies[m.Topology]
+	r.Max = customRoomMax
+	if len(m.Spawns) < r.Max {
+		r.Max = len(m.Spawns)
+	}
+	return nil
+}
+
+// Method Game makes the game the room's players will play. It fails if the
+// room's map can't be used, rather than starting a different game.
+func (r *Room) Game() (*Game, error) {
 	countrylist := make([]string, 0, len(r.Countries))
 	for country, _ := range r.Countries {
 		countrylist = append(countrylist, country)
 	}
-	return NewGame(countrylist, (len(countrylist)+1)*10, (len(countrylist)+1)*10, r.Is2v2)
+	if r.Map != nil {
+		g, err := r.Map.Game(countrylist, r.Is2v2, rand.Int63())
+		if err != nil {
+			return nil, err
+		}
+		g.Rules = r.Rules
+		if g.Rules.Barbarians {
+			r.Map.PlaceCamps(g)
+		}
+		return g, nil
+	}
+
+	aspect, _ := parseAspect(r.Aspect)
+	width, height := mapDimensions(len(countrylist), r.Size, aspect)
+	g := NewGame(countrylist, width, height, r.Topology, r.Is2v2, rand.Int63())
+	g.Rules = r.Rules
+	if g.Rules.Barbarians {
+		g.PlaceCamps(len(countrylist))
+	}
+	return g, nil
 }
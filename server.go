@@ -18,15 +18,22 @@
 	This is the game of countries.io. You can access a demo of this at http://countriesio.xyz/
 
 	This program will serve the game on localhost:$PORT. If $PORT is not set, the program will serve on port 8080.
+	Run it with -help to see the other settings. They can also be kept in a JSON file given by -config.
 */
 package main
 
 import (
+	"context"
+	"flag"
+	"io/ioutil"
 	"log"
 	"math/rand"
 	"net/http"
+	"net/url"
 	"os"
+	"os/signal"
 	"strings"
+	"syscall"
 	"time"
 
 	"github.com/gorilla/websocket"
@@ -43,29 +50,126 @@ var gameUpgrader = websocket.Upgrader{
 }
 
 func main() {
+	config := defaultConfig()
+	config.addFlags(flag.CommandLine)
+	configFile := flag.String("config", "", "JSON file with settings, overridden by flags")
+	simulateGames := flag.Int("simulate", 0, "play this many bot games with each comeback rule and exit")
+	simulatePlayers := flag.Int("simulate-players", 4, "number of bots in each simulated game")
+	simulateTurns := flag.Int("simulate-turns", 2000, "maximum length of a simulated game")
+	flag.BoolVar(&debugChecks, "debug-checks", false, "check the game's bookkeeping against the map every turn and panic if it's wrong, for testing changes with -simulate")
+	flag.Parse()
+
+	if *configFile != "" {
+		if err := config.load(*configFile); err != nil {
+			log.Fatal(err)
+		}
+		// Parse again so the command line wins over the file
+		flag.Parse()
+	}
+	if err := config.check(); err != nil {
+		log.Fatal(err)
+	}
+
+	logLevel = logLevels[config.LogLevel]
+	roomModes = config.Modes
+	lobbyCountdown = config.LobbyCountdown.Duration
+	checkpointInterval = config.Checkpoint.Duration
+	adminToken = config.AdminToken
+	proxies, err := parseProxies(config.TrustedProxies)
+	if err != nil {
+		log.Fatal(err)
+	}
+	trustedProxies = proxies
+
+	if config.Bans != "" {
+		b, err := openBans(config.Bans)
+		if err != nil {
+			log.Fatal(err)
+		}
+		bans = b
+	}
+
+	if config.History != "" {
+		h, err := openHistory(config.History)
+		if err != nil {
+			log.Fatal(err)
+		}
+		history = h
+	}
+
+	if config.Maps != "" {
+		m, err := openMaps(config.Maps)
+		if err != nil {
+			log.Fatal(err)
+		}
+		maps = m
+	}
+
+	if config.BannedWords != "" {
+		data, err := ioutil.ReadFile(config.BannedWords)
+		if err != nil {
+			log.Fatal(err)
+		}
+		chatFilter = newWordFilter(strings.Fields(string(data)))
+	}
+
+	tick, err := parseSpeed(config.Speed)
+	if err != nil {
+		log.Fatal(err)
+	}
+	defaultTickLength = tick
+
+	defaultRules, err = parseRules(config.Rules)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	if *simulateGames > 0 {
+		log.SetOutput(ioutil.Discard)
+		runSimulations(*simulateGames, *simulatePlayers, *simulateTurns)
+		return
+	}
+
 	rand.Seed(time.Now().UnixNano())
 
-	http.HandleFunc("/style.css", func(w http.ResponseWriter, r *http.Request) {
-		http.ServeFile(w, r, "style.css")
-	})
-	http.HandleFunc("/city.svg", func(w http.ResponseWriter, r *http.Request) {
-		http.ServeFile(w, r, "city.svg")
-	})
-	http.HandleFunc("/capital.svg", func(w http.ResponseWriter, r *http.Request) {
-		http.ServeFile(w, r, "capital.svg")
-	})
-	http.HandleFunc("/school.svg", func(w http.ResponseWriter, r *http.Request) {
-		http.ServeFile(w, r, "school.svg")
-	})
-	http.HandleFunc("/portal.svg", func(w http.ResponseWriter, r *http.Request) {
-		http.ServeFile(w, r, "portal.svg")
-	})
-	http.HandleFunc("/launcher.svg", func(w http.ResponseWriter, r *http.Request) {
-		http.ServeFile(w, r, "launcher.svg")
-	})
-	http.HandleFunc("/sound.wav", func(w http.ResponseWriter, r *http.Request) {
-		http.ServeFile(w, r, "sound.wav")
-	})
+	staticDir := ""
+	if config.Dev {
+		staticDir = config.Static
+	}
+	assets, err = openAssets(staticDir)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	if config.Snapshots != "" {
+		s, err := openSnapshots(config.Snapshots)
+		if err != nil {
+			log.Fatal(err)
+		}
+		snapshots = s
+
+		saved, errs := snapshots.Load()
+		for _, err := range errs {
+			log.Println(err)
+		}
+		for _, snapshot := range saved {
+			if err := resumeGameThread(snapshot); err != nil {
+				log.Println(snapshot.Id+":", err)
+			}
+		}
+	}
+
+	for _, name := range assets.Names() {
+		http.Handle("/"+name, assets.Handler(name))
+	}
+
+	http.HandleFunc("/api/games", handleApiGames)
+	http.HandleFunc("/api/games/", handleApiGames)
+	http.HandleFunc("/api/players/", handleApiPlayers)
+	http.HandleFunc("/api/maps", handleApiMaps)
+	http.HandleFunc("/api/maps/", handleApiMaps)
+	http.HandleFunc("/metrics", handleMetrics)
+	http.HandleFunc("/api/admin/", handleApiAdmin)
 
 	http.HandleFunc("/ws/room", func(w http.ResponseWriter, r *http.Request) {
 		conn, err := roomUpgrader.Upgrade(w, r, nil)
@@ -73,21 +177,8 @@ func main() {
 			log.Println(err)
 			return
 		}
-
-		// wait for join command
-		for {
-			mt, msg, err := conn.ReadMessage()
-			if _, ok := err.(*websocket.CloseError); ok {
-				handleRoomCommand(conn, websocket.CloseMessage, nil)
-				return
-			}
-			if err != nil {
-				log.Println(err)
-				return
-			}
-			args := strings.Fields(string(msg))
-			handleRoomCommand(conn, mt, args)
-		}
+		setConnIP(conn, r)
+		readCommands(conn, roomCommandRate, &roomConns, handleRoomCommand)
 	})
 
 	http.HandleFunc("/ws/game", func(w http.ResponseWriter, r *http.Request) {
@@ -96,20 +187,8 @@ func main() {
 			log.Println(err)
 			return
 		}
-
-		for {
-			mt, msg, err := conn.ReadMessage()
-			if _, ok := err.(*websocket.CloseError); ok {
-				handleGameCommand(conn, websocket.CloseMessage, nil)
-				return
-			}
-			if err != nil {
-				log.Println(err)
-				return
-			}
-			args := strings.Fields(string(msg))
-			handleGameCommand(conn, mt, args)
-		}
+		setConnIP(conn, r)
+		readCommands(conn, gameCommandRate, &gameConns, handleGameCommand)
 	})
 
 	http.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
@@ -118,25 +197,44 @@ func main() {
 			w.WriteHeader(302)
 			return
 		}
-		http.ServeFile(w, r, "index.html")
-	})
-	http.HandleFunc("/ffa", func(w http.ResponseWriter, r *http.Request) {
-		http.ServeFile(w, r, "room.html")
-	})
-	http.HandleFunc("/1v1", func(w http.ResponseWriter, r *http.Request) {
-		http.ServeFile(w, r, "room.html")
-	})
-	http.HandleFunc("/2v2", func(w http.ResponseWriter, r *http.Request) {
-		http.ServeFile(w, r, "room.html")
-	})
-	http.HandleFunc("/play", func(w http.ResponseWriter, r *http.Request) {
-		http.ServeFile(w, r, "game.html")
+		assets.serve(w, r, "index.html")
 	})
+	http.Handle("/custom/", assets.Handler("room.html"))
+	http.Handle("/editor", assets.Handler("editor.html"))
+	http.Handle("/play", assets.Handler("game.html"))
+	http.Handle("/admin", assets.Handler("admin.html"))
 
-	port := os.Getenv("PORT")
-	if port == "" {
-		port = "8080"
+	// Modes get the paths that nothing above uses
+	for mode := range roomModes {
+		path := &http.Request{Method: http.MethodGet, URL: &url.URL{Path: "/" + mode}}
+		if _, pattern := http.DefaultServeMux.Handler(path); pattern != "/" {
+			log.Fatalf("mode %s: %s is already taken", mode, pattern)
+		}
+		http.Handle("/"+mode, assets.Handler("room.html"))
 	}
 
-	http.ListenAndServe(":"+port, nil)
+	server := &http.Server{Addr: config.Listen}
+	stopped := make(chan struct{})
+	go func() {
+		signals := make(chan os.Signal, 1)
+		signal.Notify(signals, syscall.SIGTERM, os.Interrupt)
+		<-signals
+		logInfo("draining")
+		drain(config.Drain.Duration, signals)
+
+		ctx, cancel := context.WithTimeout(context.Background(), stopTimeout)
+		defer cancel()
+		server.Shutdown(ctx)
+		close(stopped)
+	}()
+
+	if config.TLSCert != "" {
+		err = server.ListenAndServeTLS(config.TLSCert, config.TLSKey)
+	} else {
+		err = server.ListenAndServe()
+	}
+	if err != http.ErrServerClosed {
+		log.Fatal(err)
+	}
+	<-stopped
 }
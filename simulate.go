@@ -0,0 +1,175 @@
+// countries.io
+// Copyright (C) 2019 Allen B
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program. If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"fmt"
+	"math/rand"
+	"strconv"
+)
+
+// Type simulationResult is the outcome of a game played by bots
+type simulationResult struct {
+	Turns int
+	Ended bool
+
+	// The country with the most land at the checkpoint didn't win
+	Comeback bool
+
+	// How many times the country with the most land changed
+	LeadChanges int
+}
+
+// Function simulate plays a game between simple bots until it ends or
+// maxTurns is reached. It's used to measure the effect of rules.
+func simulate(rules Rules, topology Topology, players int, maxTurns int, seed int64) simulationResult {
+	countries := make([]string, players)
+	for i := range countries {
+		countries[i] = "bot" + strconv.Itoa(i)
+	}
+	width, height := mapDimensions(players, "medium", 1)
+	g := NewGame(countries, width, height, topology, false, seed)
+	g.Rules = rules
+	if rules.Barbarians {
+		g.PlaceCamps(players)
+	}
+	random := rand.New(rand.NewSource(seed))
+
+	result := simulationResult{}
+	checkpoint := maxTurns / 4
+	leaderAtCheckpoint := -1
+	leader := -1
+
+	for g.Turn < maxTurns && !g.Ended() {
+		// Two ticks per turn, like startGameThread
+		for tick := 0; tick < 2; tick++ {
+			for country := range g.Countries {
+				if !g.Losers[country] {
+					botMove(g, country, random)
+				}
+			}
+		}
+		g.NextTurn()
+
+		land, _, _ := g.Totals()
+		newLeader := mostLand(land)
+		if leader >= 0 && newLeader != leader {
+			result.LeadChanges++
+		}
+		leader = newLeader
+		if g.Turn == checkpoint {
+			leaderAtCheckpoint = leader
+		}
+	}
+
+	result.Turns = g.Turn
+	result.Ended = g.Ended()
+	winner := leader
+	if result.Ended {
+		if winners := g.Winners(); len(winners) != 0 {
+			winner = winners[0]
+		}
+	}
+	result.Comeback = leaderAtCheckpoint >= 0 && winner != leaderAtCheckpoint
+	return result
+}
+
+func mostLand(land []uint) int {
+	best := 0
+	for country, count := range land {
+		if count > land[best] {
+			best = country
+		}
+	}
+	return best
+}
+
+// Makes one move for a bot: attack with its biggest army, and sometimes build
+func botMove(g *Game, country int, random *rand.Rand) {
+	from := -1
+	for tile, terrain := range g.Terrain {
+		if terrain == country && !g.Has(tile, BUILDING_SCHOOL) && (from < 0 || g.Armies[tile] > g.Armies[from]) {
+			from = tile
+		}
+	}
+	if from < 0 || g.Armies[from] < 2 {
+		return
+	}
+
+	neighbors := g.Neighbors(from)
+
+	// Attack the weakest tile we can take, otherwise wander
+	target := -1
+	for _, tile := range neighbors {
+		if g.Terrain[tile] == country || g.Terrain[tile] == TILE_WALL || g.Armies[tile]+1 >= g.Armies[from] {
+			continue
+		}
+		if target < 0 || g.Armies[tile] < g.Armies[target] {
+			target = tile
+		}
+	}
+	if target < 0 {
+		target = neighbors[random.Intn(len(neighbors))]
+	}
+	g.Attack(country, from, target, false)
+
+	if g.Turn%10 == 0 {
+		tile := random.Intn(len(g.Terrain))
+		g.MakeCity(country, tile)
+		g.MakeSchool(country, tile)
+		for _, tech := range techTree {
+			g.Research(country, tech.Id)
+		}
+	}
+}
+
+// Function runSimulations plays games with every comeback rule on its own,
+// with all of them and with none of them, and prints the results
+func runSimulations(games int, players int, maxTurns int) {
+	ruleSets := []struct {
+		Name  string
+		Rules Rules
+	}{
+		{"none", Rules{}},
+		{"rebuild_capital", Rules{RebuildCapital: true}},
+		{"rebels", Rules{Rebels: true}},
+		{"growth_penalty", Rules{GrowthPenalty: true}},
+		{"all", Rules{RebuildCapital: true, Rebels: true, GrowthPenalty: true}},
+	}
+
+	fmt.Printf("%-16s %8s %8s %10s %12s\n", "rules", "turns", "ended", "comebacks", "lead changes")
+	for _, set := range ruleSets {
+		turns, ended, comebacks, leadChanges := 0, 0, 0, 0
+		for i := 0; i < games; i++ {
+			// The same seeds for every rule set
+			result := simulate(set.Rules, squareTopology{}, players, maxTurns, int64(i))
+			turns += result.Turns
+			leadChanges += result.LeadChanges
+			if result.Ended {
+				ended++
+			}
+			if result.Comeback {
+				comebacks++
+			}
+		}
+		fmt.Printf("%-16s %8.0f %7.0f%% %9.0f%% %12.1f\n", set.Name,
+			float64(turns)/float64(games),
+			float64(ended)*100/float64(games),
+			float64(comebacks)*100/float64(games),
+			float64(leadChanges)/float64(games))
+	}
+}
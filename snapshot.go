@@ -0,0 +1,347 @@
+// countries.io
+// Copyright (C) 2019 Allen B
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program. If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// The version of the snapshot format. Snapshots of other versions aren't restored.
+const snapshotVersion = 1
+
+// How long a restored game waits for its players to reconnect before it carries on
+const reconnectTimeout = time.Minute
+
+// Type gameSnapshot is everything needed to carry on a running game after a restart
+type gameSnapshot struct {
+	Version int    `json:"version"`
+	Id      string `json:"id"`
+
+	Mode string `json:"mode"`
+	Tick int64  `json:"tick"` // ms
+	Host int    `json:"host"`
+
+	Start time.Time `json:"start"`
+
+	// True if the next tick starts a new turn
+	TurnTick bool `json:"turn_tick"`
+
+	Game    gameState      `json:"game"`
+	Pause   *pauseState    `json:"pause"`
+	Stats   *gameStats     `json:"stats"`
+	Replay  *replay        `json:"replay"`  // without updates, which are in the history's stream
+	Updates int            `json:"updates"` // how many updates the stream had
+	Chat    []chatMessage  `json:"chat"`
+	Pending pendingActions `json:"pending"`
+	Secrets []string       `json:"secrets"` // join secret = [countryIndex]
+}
+
+// Type gameState is a Game in a form that can be stored
+type gameState struct {
+	Countries []string `json:"countries"`
+	Width     int      `json:"width"`
+	Height    int      `json:"height"`
+	Topology  string   `json:"topology"`
+	Is2v2     bool     `json:"is_2v2"`
+	Seed      int64    `json:"seed"`
+	Rules     Rules    `json:"rules"`
+	Turn      int      `json:"turn"`
+
+	Terrain   []int      `json:"terrain"`
+	Armies    []uint     `json:"armies"`
+	Buildings []Building `json:"buildings"`
+
+	Losers         []int             `json:"losers"`
+	Gold           []int             `json:"gold"`
+	Food           []int             `json:"food"`
+	ResearchPoints []int             `json:"research"`
+	Techs          []map[string]bool `json:"techs"`
+
+	Pacts            []pactState     `json:"pacts"`
+	Proposals        []proposalState `json:"proposals"`
+	DiplomacyVersion int             `json:"diplomacy_version"`
+
+	CapitalLost  []int `json:"capital_lost"`
+	LastRelocate []int `json:"last_relocate"`
+}
+
+type pactState struct {
+	Countries [2]int `json:"countries"`
+	Pact      Pact   `json:"pact"`
+}
+
+type proposalState struct {
+	From int `json:"from"`
+	To   int `json:"to"`
+	Type int `json:"type"`
+}
+
+// Type pendingActions is what players sent that the game thread hasn't handled yet
+type pendingActions struct {
+	Builds    map[string][][]int  `json:"builds"` // tiles = [command][countryIndex]
+	Diplomacy [][]diplomacyAction `json:"diplomacy"`
+	Research  [][]string          `json:"research"`
+}
+
+// Method with returns the actions in p followed by the ones in q. It doesn't change
+// p, so a snapshot holding p can be encoded while the game goes on.
+func (p pendingActions) with(q pendingActions) pendingActions {
+	out := pendingActions{Builds: make(map[string][][]int)}
+	for _, command := range buildCommands {
+		for countryIndex := 0; countryIndex < len(p.Builds[command]) || countryIndex < len(q.Builds[command]); countryIndex++ {
+			var tiles []int
+			if countryIndex < len(p.Builds[command]) {
+				tiles = append(tiles, p.Builds[command][countryIndex]...)
+			}
+			if countryIndex < len(q.Builds[command]) {
+				tiles = append(tiles, q.Builds[command][countryIndex]...)
+			}
+			out.Builds[command] = append(out.Builds[command], tiles)
+		}
+	}
+	for countryIndex := 0; countryIndex < len(p.Diplomacy) || countryIndex < len(q.Diplomacy); countryIndex++ {
+		var actions []diplomacyAction
+		if countryIndex < len(p.Diplomacy) {
+			actions = append(actions, p.Diplomacy[countryIndex]...)
+		}
+		if countryIndex < len(q.Diplomacy) {
+			actions = append(actions, q.Diplomacy[countryIndex]...)
+		}
+		out.Diplomacy = append(out.Diplomacy, actions)
+	}
+	for countryIndex := 0; countryIndex < len(p.Research) || countryIndex < len(q.Research); countryIndex++ {
+		var techs []string
+		if countryIndex < len(p.Research) {
+			techs = append(techs, p.Research[countryIndex]...)
+		}
+		if countryIndex < len(q.Research) {
+			techs = append(techs, q.Research[countryIndex]...)
+		}
+		out.Research = append(out.Research, techs)
+	}
+	return out
+}
+
+// Method state returns a copy of the game in a form that can be stored.
+// It doesn't share anything with the game, so it can be encoded while the game goes on.
+func (g *Game) state() gameState {
+	s := gameState{
+		Countries:        g.Countries,
+		Width:            g.Width,
+		Height:           g.Height,
+		Topology:         g.Topology.Name(),
+		Is2v2:            g.Is2v2,
+		Seed:             g.Seed,
+		Rules:            g.Rules,
+		Turn:             g.Turn,
+		Terrain:          append([]int(nil), g.Terrain...),
+		Armies:           append([]uint(nil), g.Armies...),
+		Buildings:        append([]Building(nil), g.Buildings...),
+		Losers:           make([]int, 0, len(g.Losers)),
+		Gold:             append([]int(nil), g.Gold...),
+		Food:             append([]int(nil), g.Food...),
+		ResearchPoints:   append([]int(nil), g.ResearchPoints...),
+		Techs:            make([]map[string]bool, len(g.Techs)),
+		Pacts:            make([]pactState, 0, len(g.Pacts)),
+		Proposals:        make([]proposalState, 0, len(g.Proposals)),
+		DiplomacyVersion: g.DiplomacyVersion,
+		CapitalLost:      append([]int(nil), g.CapitalLost...),
+		LastRelocate:     append([]int(nil), g.LastRelocate...),
+	}
+	for country, techs := range g.Techs {
+		s.Techs[country] = make(map[string]bool, len(techs))
+		for tech, has := range techs {
+			s.Techs[country][tech] = has
+		}
+	}
+	for loser, _ := range g.Losers {
+		s.Losers = append(s.Losers, loser)
+	}
+	for key, pact := range g.Pacts {
+		s.Pacts = append(s.Pacts, pactState{Countries: key, Pact: *pact})
+	}
+	for key, pactType := range g.Proposals {
+		s.Proposals = append(s.Proposals, proposalState{From: key[0], To: key[1], Type: pactType})
+	}
+	return s
+}
+
+// Method Game rebuilds a Game from its stored form.
+// Random numbers after a restore come from the seed and the turn.
+func (s *gameState) Game() (*Game, error) {
+	topology, ok := topologies[s.Topology]
+	if !ok {
+		return nil, fmt.Errorf("unknown map type %s", s.Topology)
+	}
+	size := s.Width * s.Height
+	countries := len(s.Countries)
+	if len(s.Terrain) != size || len(s.Armies) != size || len(s.Buildings) != size {
+		return nil, fmt.Errorf("map should have %d tiles", size)
+	}
+	for _, list := range [][]int{s.Gold, s.Food, s.ResearchPoints, s.CapitalLost, s.LastRelocate} {
+		if len(list) != countries {
+			return nil, fmt.Errorf("country lists should have %d countries", countries)
+		}
+	}
+	if len(s.Techs) != countries {
+		return nil, fmt.Errorf("country lists should have %d countries", countries)
+	}
+
+	g := newEmptyGame(s.Countries, s.Width, s.Height, topology, s.Is2v2, s.Seed)
+	g.Rules = s.Rules
+	g.Turn = s.Turn
+	g.Terrain = s.Terrain
+	g.Armies = s.Armies
+	g.Buildings = s.Buildings
+	for _, loser := range s.Losers {
+		g.Losers[loser] = true
+	}
+	g.Gold = s.Gold
+	g.Food = s.Food
+	g.ResearchPoints = s.ResearchPoints
+	g.Techs = s.Techs
+	for country := range g.Techs {
+		if g.Techs[country] == nil {
+			g.Techs[country] = make(map[string]bool)
+		}
+	}
+	for _, pact := range s.Pacts {
+		p := pact.Pact
+		g.Pacts[pact.Countries] = &p
+	}
+	for _, proposal := range s.Proposals {
+		g.Proposals[[2]int{proposal.From, proposal.To}] = proposal.Type
+	}
+	g.DiplomacyVersion = s.DiplomacyVersion
+	g.CapitalLost = s.CapitalLost
+	g.LastRelocate = s.LastRelocate
+	g.random = rand.New(rand.NewSource(s.Seed ^ int64(s.Turn)))
+
+	g.rebuildTileTypes()
+	g.rebuildTotals()
+	return g, nil
+}
+
+// Type snapshotStore keeps snapshots of running games on disk, one file per game in Dir
+type snapshotStore struct {
+	Dir string
+}
+
+// Where running games are checkpointed. nil if checkpoints are disabled.
+var snapshots *snapshotStore
+
+// How often running games are checkpointed
+var checkpointInterval = 30 * time.Second
+
+// Function openSnapshots opens the snapshots in a directory
+func openSnapshots(dir string) (*snapshotStore, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	return &snapshotStore{Dir: dir}, nil
+}
+
+// Method Save writes a snapshot, replacing the last one of the same game
+func (s *snapshotStore) Save(snapshot *gameSnapshot) error {
+	data, err := json.Marshal(snapshot)
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(filepath.Join(s.Dir, snapshot.Id+".json"), data)
+}
+
+// Type checkpointer saves the snapshots of one game in the background, so encoding
+// and writing them doesn't hold up its ticks. Only one is written at a time.
+type checkpointer struct {
+	busy chan struct{}
+}
+
+func newCheckpointer() *checkpointer {
+	return &checkpointer{busy: make(chan struct{}, 1)}
+}
+
+// Method Start starts saving a snapshot. It returns false, and saves nothing, if the
+// last snapshot is still being written or the checkpointer was stopped.
+func (c *checkpointer) Start(snapshot *gameSnapshot) bool {
+	select {
+	case c.busy <- struct{}{}:
+	default:
+		return false
+	}
+	go func() {
+		if err := snapshots.Save(snapshot); err != nil {
+			log.Println(err)
+		}
+		<-c.busy
+	}()
+	return true
+}
+
+// Method Stop waits for the snapshot being written, if any, and stops any more
+// from being started, so an old snapshot can't land after a newer one or a delete
+func (c *checkpointer) Stop() {
+	c.busy <- struct{}{}
+}
+
+// Method Delete removes the snapshot of a game that ended
+func (s *snapshotStore) Delete(id string) error {
+	err := os.Remove(filepath.Join(s.Dir, id+".json"))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	return err
+}
+
+// Method Load reads every snapshot. Snapshots that can't be read are returned as errors
+// and left on disk.
+func (s *snapshotStore) Load() ([]*gameSnapshot, []error) {
+	files, err := ioutil.ReadDir(s.Dir)
+	if err != nil {
+		return nil, []error{err}
+	}
+	out := make([]*gameSnapshot, 0)
+	errs := make([]error, 0)
+	for _, file := range files {
+		if !strings.HasSuffix(file.Name(), ".json") {
+			continue
+		}
+		data, err := ioutil.ReadFile(filepath.Join(s.Dir, file.Name()))
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		snapshot := new(gameSnapshot)
+		if err := json.Unmarshal(data, snapshot); err != nil {
+			errs = append(errs, fmt.Errorf("%s: %v", file.Name(), err))
+			continue
+		}
+		if snapshot.Version != snapshotVersion {
+			errs = append(errs, fmt.Errorf("%s: unsupported snapshot version %d", file.Name(), snapshot.Version))
+			continue
+		}
+		out = append(out, snapshot)
+	}
+	return out, errs
+}
@@ -0,0 +1,197 @@
+// countries.io
+// Copyright (C) 2019 Allen B
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program. If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"math/rand"
+	"reflect"
+	"strconv"
+	"testing"
+)
+
+// Plays bot moves for a number of turns, or until the game ends
+func playBots(g *Game, random *rand.Rand, turns int) {
+	for end := g.Turn + turns; g.Turn < end && !g.Ended(); {
+		for country := range g.Countries {
+			if !g.Losers[country] {
+				botMove(g, country, random)
+			}
+		}
+		g.NextTurn()
+	}
+}
+
+// Fails the test if two games aren't in the same state
+func compareGames(t *testing.T, after string, a *Game, b *Game) {
+	t.Helper()
+	for _, field := range []struct {
+		name string
+		a, b interface{}
+	}{
+		{"turn", a.Turn, b.Turn},
+		{"terrain", a.Terrain, b.Terrain},
+		{"armies", a.Armies, b.Armies},
+		{"buildings", a.Buildings, b.Buildings},
+		{"totals", a.totals, b.totals},
+		{"tile types", a.tileTypes, b.tileTypes},
+		{"losers", a.Losers, b.Losers},
+		{"gold", a.Gold, b.Gold},
+		{"food", a.Food, b.Food},
+		{"research", a.ResearchPoints, b.ResearchPoints},
+		{"techs", a.Techs, b.Techs},
+		{"pacts", a.Pacts, b.Pacts},
+		{"proposals", a.Proposals, b.Proposals},
+		{"lost capitals", a.CapitalLost, b.CapitalLost},
+		{"relocations", a.LastRelocate, b.LastRelocate},
+	} {
+		if !reflect.DeepEqual(field.a, field.b) {
+			t.Errorf("after %s the %s differ", after, field.name)
+		}
+	}
+}
+
+// Saves seeded games part of the way through, loads them back and checks they carry on
+// the same way as the games that kept going
+func TestSnapshotRoundTrip(t *testing.T) {
+	store, err := openSnapshots(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	for seed := int64(1); seed <= 3; seed++ {
+		countries := []string{"bot0", "bot1", "bot2", "bot3"}
+		width, height := mapDimensions(len(countries), "small", 1)
+		g := NewGame(countries, width, height, squareTopology{}, false, seed)
+		g.Rules = allRules
+		g.PlaceCamps(len(countries))
+		playBots(g, rand.New(rand.NewSource(seed)), 150)
+		g.Propose(0, 1, PACT_TRUCE)
+		g.Accept(1, 0)
+		g.Propose(2, 3, PACT_PEACE)
+
+		id := "seed" + strconv.FormatInt(seed, 10)
+		if err := store.Save(&gameSnapshot{Version: snapshotVersion, Id: id, Game: g.state()}); err != nil {
+			t.Fatal(err)
+		}
+		saved, errs := store.Load()
+		if len(errs) != 0 {
+			t.Fatal(errs)
+		}
+		var restored *Game
+		for _, snapshot := range saved {
+			if snapshot.Id == id {
+				if restored, err = snapshot.Game.Game(); err != nil {
+					t.Fatal(err)
+				}
+			}
+		}
+		if restored == nil {
+			t.Fatalf("%s wasn't loaded", id)
+		}
+		compareGames(t, "restoring", g, restored)
+
+		// A restored game draws random numbers from the seed and the turn, so the
+		// original has to as well to play the same
+		g.random = rand.New(rand.NewSource(g.Seed ^ int64(g.Turn)))
+		playBots(g, rand.New(rand.NewSource(seed+100)), 150)
+		playBots(restored, rand.New(rand.NewSource(seed+100)), 150)
+		compareGames(t, "playing on", g, restored)
+	}
+}
+
+func TestPendingActionsWith(t *testing.T) {
+	truce := diplomacyAction{Action: "propose", Country: 1, Pact: PACT_TRUCE}
+	accept := diplomacyAction{Action: "accept", Country: 0}
+	tests := []struct {
+		name string
+		p, q pendingActions
+		want pendingActions
+	}{
+		{
+			name: "empty",
+			want: pendingActions{Builds: map[string][][]int{}},
+		},
+		{
+			name: "only p",
+			p: pendingActions{
+				Builds:   map[string][][]int{"city": {{1, 2}, {3}}},
+				Research: [][]string{{"granary"}},
+			},
+			want: pendingActions{
+				Builds:   map[string][][]int{"city": {{1, 2}, {3}}},
+				Research: [][]string{{"granary"}},
+			},
+		},
+		{
+			name: "p first",
+			p: pendingActions{
+				Builds:    map[string][][]int{"wall": {{1}, {2}}},
+				Diplomacy: [][]diplomacyAction{{truce}},
+			},
+			q: pendingActions{
+				Builds:    map[string][][]int{"wall": {{3}, {4}}},
+				Diplomacy: [][]diplomacyAction{{accept}},
+			},
+			want: pendingActions{
+				Builds:    map[string][][]int{"wall": {{1, 3}, {2, 4}}},
+				Diplomacy: [][]diplomacyAction{{truce, accept}},
+			},
+		},
+		{
+			name: "more countries in q",
+			p: pendingActions{
+				Builds:   map[string][][]int{"city": {{1}}},
+				Research: [][]string{{"granary"}},
+			},
+			q: pendingActions{
+				Builds:    map[string][][]int{"city": {nil, {2}, {3}}, "portal": {{4}}},
+				Diplomacy: [][]diplomacyAction{nil, {accept}},
+				Research:  [][]string{nil, nil, {"portals"}},
+			},
+			want: pendingActions{
+				Builds:    map[string][][]int{"city": {{1}, {2}, {3}}, "portal": {{4}}},
+				Diplomacy: [][]diplomacyAction{nil, {accept}},
+				Research:  [][]string{{"granary"}, nil, {"portals"}},
+			},
+		},
+		{
+			name: "more countries in p",
+			p: pendingActions{
+				Builds:    map[string][][]int{"collect": {{1}, {2}, {3}}},
+				Diplomacy: [][]diplomacyAction{{truce}, {accept}},
+			},
+			q: pendingActions{
+				Builds:    map[string][][]int{"collect": {{4}}},
+				Diplomacy: [][]diplomacyAction{{accept}},
+			},
+			want: pendingActions{
+				Builds:    map[string][][]int{"collect": {{1, 4}, {2}, {3}}},
+				Diplomacy: [][]diplomacyAction{{truce, accept}, {accept}},
+			},
+		},
+	}
+	for _, test := range tests {
+		pBefore := test.p.with(pendingActions{})
+		got := test.p.with(test.q)
+		if !reflect.DeepEqual(got, test.want) {
+			t.Errorf("%s: got %+v, want %+v", test.name, got, test.want)
+		}
+		// p is left alone, since a snapshot might still be encoding it
+		if got := test.p.with(pendingActions{}); !reflect.DeepEqual(got, pBefore) {
+			t.Errorf("%s: p changed to %+v", test.name, test.p)
+		}
+	}
+}
@@ -0,0 +1,234 @@
+// countries.io
+// Copyright (C) 2019 Allen B
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program. If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+// How many rounds of moving spawns around placeSpawns does at most
+const spawnPasses = 100
+
+// Function distancesFrom returns how many steps it takes to get from a tile to every
+// other tile without crossing blocked tiles, -1 if it can't be reached
+func distancesFrom(topology Topology, width int, height int, from int, blocked map[int]bool) []int {
+	distances := make([]int, width*height)
+	for tile := range distances {
+		distances[tile] = -1
+	}
+	distances[from] = 0
+	queue := []int{from}
+	for len(queue) > 0 {
+		tile := queue[0]
+		queue = queue[1:]
+		for _, neighbor := range topology.Neighbors(width, height, tile) {
+			if distances[neighbor] >= 0 || blocked[neighbor] {
+				continue
+			}
+			distances[neighbor] = distances[tile] + 1
+			queue = append(queue, neighbor)
+		}
+	}
+	return distances
+}
+
+// Method placeSpawns picks n tiles for capitals that are as far apart as possible,
+// with every capital about as far from its nearest neighbour as the others.
+//
+// Tiles are first picked one by one, each as far as possible from the ones before it.
+// Then spawns are moved a tile at a time while that makes the layout better, for at most
+// spawnPasses rounds, so this always finishes.
+func (g *Game) placeSpawns(n int) []int {
+	size := g.Width * g.Height
+	if n > size {
+		n = size
+	}
+	spawns := make([]int, 0, n)
+	fields := make([][]int, 0, n) // distances from each spawn
+
+	// Farthest point sampling
+	nearest := make([]int, size)
+	for tile := range nearest {
+		nearest[tile] = -1
+	}
+	for len(spawns) < n {
+		tile := -1
+		if len(spawns) == 0 {
+			tile = g.random.Intn(size)
+		} else {
+			ties := 0
+			for t, distance := range nearest {
+				if tile >= 0 && distance < nearest[tile] {
+					continue
+				}
+				if tile >= 0 && distance == nearest[tile] {
+					ties++
+					if g.random.Intn(ties) != 0 {
+						continue
+					}
+				} else {
+					ties = 1
+				}
+				tile = t
+			}
+		}
+		field := distancesFrom(g.Topology, g.Width, g.Height, tile, nil)
+		for t, distance := range field {
+			if nearest[t] < 0 || distance < nearest[t] {
+				nearest[t] = distance
+			}
+		}
+		spawns = append(spawns, tile)
+		fields = append(fields, field)
+	}
+
+	// Local search
+	best := scoreSpawns(spawns, fields)
+	for pass := 0; pass < spawnPasses; pass++ {
+		improved := false
+		for i, spawn := range spawns {
+			for _, tile := range g.Neighbors(spawn) {
+				if fields[i][tile] < 0 || containsTile(spawns, tile) {
+					continue
+				}
+				oldField := fields[i]
+				spawns[i] = tile
+				fields[i] = distancesFrom(g.Topology, g.Width, g.Height, tile, nil)
+				if score := scoreSpawns(spawns, fields); score.better(best) {
+					best = score
+					spawn = tile
+					improved = true
+				} else {
+					spawns[i] = spawn
+					fields[i] = oldField
+				}
+			}
+		}
+		if !improved {
+			break
+		}
+	}
+
+	if g.Is2v2 {
+		pairTeammates(spawns, fields)
+	}
+	return spawns
+}
+
+// How good a spawn layout is
+type spawnScore struct {
+	Closest  int // distance between the two closest spawns
+	Spread   int // difference between the largest and smallest nearest neighbour distance
+	Distance int // sum of nearest neighbour distances
+}
+
+// Bigger gaps first, then fairness, then more room overall
+func (s spawnScore) better(other spawnScore) bool {
+	if s.Closest != other.Closest {
+		return s.Closest > other.Closest
+	}
+	if s.Spread != other.Spread {
+		return s.Spread < other.Spread
+	}
+	return s.Distance > other.Distance
+}
+
+func scoreSpawns(spawns []int, fields [][]int) spawnScore {
+	score := spawnScore{Closest: -1}
+	farthest := 0
+	for i := range spawns {
+		nearest := -1
+		for j, other := range spawns {
+			if i != j && (nearest < 0 || fields[i][other] < nearest) {
+				nearest = fields[i][other]
+			}
+		}
+		if nearest < 0 {
+			continue // only one spawn
+		}
+		if score.Closest < 0 || nearest < score.Closest {
+			score.Closest = nearest
+		}
+		if nearest > farthest {
+			farthest = nearest
+		}
+		score.Distance += nearest
+	}
+	score.Spread = farthest - score.Closest
+	return score
+}
+
+// Reorders spawns so that countries 2i and 2i+1, who are a team, start next to each other.
+// Of all the ways to split the spawns into pairs, it picks the one where teammates are
+// closest in total. 2v2 games have 4 players, so there are only 3 to try.
+func pairTeammates(spawns []int, fields [][]int) {
+	best := -1
+	bestOrder := make([]int, 0, len(spawns))
+	order := make([]int, 0, len(spawns))
+	used := make([]bool, len(spawns))
+	var pair func(total int)
+	pair = func(total int) {
+		if best >= 0 && total >= best {
+			return
+		}
+		first := -1
+		for i := range used {
+			if !used[i] {
+				first = i
+				break
+			}
+		}
+		if first < 0 {
+			best = total
+			bestOrder = append(bestOrder[:0], order...)
+			return
+		}
+		used[first] = true
+		order = append(order, first)
+		alone := true
+		for j := first + 1; j < len(used); j++ {
+			if used[j] {
+				continue
+			}
+			alone = false
+			used[j] = true
+			order = append(order, j)
+			pair(total + fields[first][spawns[j]])
+			order = order[:len(order)-1]
+			used[j] = false
+		}
+		if alone {
+			// The last of an odd number of spawns has no teammate
+			pair(total)
+		}
+		order = order[:len(order)-1]
+		used[first] = false
+	}
+	pair(0)
+
+	oldSpawns := append([]int(nil), spawns...)
+	oldFields := append([][]int(nil), fields...)
+	for i, j := range bestOrder {
+		spawns[i] = oldSpawns[j]
+		fields[i] = oldFields[j]
+	}
+}
+
+func containsTile(tiles []int, tile int) bool {
+	for _, t := range tiles {
+		if t == tile {
+			return true
+		}
+	}
+	return false
+}
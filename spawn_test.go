@@ -0,0 +1,125 @@
+// countries.io
+// Copyright (C) 2019 Allen B
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program. If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"testing"
+)
+
+// Returns the distance between the two closest spawns, and fails the test if any are
+// off the map or on the same tile
+func checkSpawns(t *testing.T, g *Game, spawns []int, want int) int {
+	t.Helper()
+	if len(spawns) != want {
+		t.Fatalf("%d spawns, want %d", len(spawns), want)
+	}
+	closest := -1
+	for i, spawn := range spawns {
+		if spawn < 0 || spawn >= len(g.Terrain) {
+			t.Fatalf("spawn %d is off the map", spawn)
+		}
+		distances := distancesFrom(g.Topology, g.Width, g.Height, spawn, nil)
+		for _, other := range spawns[i+1:] {
+			if other == spawn {
+				t.Fatalf("two spawns at %d", spawn)
+			}
+			if closest < 0 || distances[other] < closest {
+				closest = distances[other]
+			}
+		}
+	}
+	return closest
+}
+
+func TestPlaceSpawns(t *testing.T) {
+	for _, players := range []int{2, 3, 4, 6} {
+		width, height := mapDimensions(players, "small", 1)
+		for name, topology := range topologies {
+			for seed := int64(1); seed <= 3; seed++ {
+				countries := make([]string, players)
+				g := newEmptyGame(countries, width, height, topology, false, seed)
+				closest := checkSpawns(t, g, g.placeSpawns(players), players)
+				// Farthest point sampling keeps them about half the map apart
+				if bound := width / 3; closest < bound {
+					t.Errorf("%d players on %s, seed %d: spawns %d apart, want at least %d", players, name, seed, closest, bound)
+				}
+
+				// Every country starts with a capital on its own land
+				g = NewGame(countries, width, height, topology, false, seed)
+				owners := make(map[int]bool)
+				for _, capital := range g.buildingTiles(BUILDING_CAPITAL) {
+					if g.Terrain[capital] < 0 || owners[g.Terrain[capital]] {
+						t.Errorf("%d players on %s, seed %d: capital at %d belongs to %d", players, name, seed, capital, g.Terrain[capital])
+					}
+					owners[g.Terrain[capital]] = true
+				}
+				if len(owners) != players {
+					t.Errorf("%d players on %s, seed %d: %d capitals", players, name, seed, len(owners))
+				}
+			}
+		}
+	}
+}
+
+// Maps with hardly any room still get as many spawns as fit, and placing them finishes
+func TestPlaceSpawnsCrowded(t *testing.T) {
+	tests := []struct {
+		width, height, players int
+		want                   int
+	}{
+		{5, 5, 6, 6},
+		{3, 3, 9, 9},
+		{2, 2, 6, 4},
+		{1, 1, 2, 1},
+		{minMapSize, minMapSize, maxModePlayers, maxModePlayers},
+	}
+	for _, test := range tests {
+		for name, topology := range topologies {
+			g := newEmptyGame(make([]string, test.players), test.width, test.height, topology, false, 1)
+			spawns := g.placeSpawns(test.players)
+			if len(spawns) != test.want {
+				t.Errorf("%dx%d %s: %d spawns, want %d", test.width, test.height, name, len(spawns), test.want)
+				continue
+			}
+			checkSpawns(t, g, spawns, test.want)
+		}
+	}
+}
+
+// Of the 3 ways to split 4 spawns into 2 teams, 2v2 games use the one with teammates closest together
+func TestPairTeammates(t *testing.T) {
+	for name, topology := range topologies {
+		for _, aspect := range []float64{1, 2, 0.5} {
+			width, height := mapDimensions(4, "small", aspect)
+			for seed := int64(1); seed <= 10; seed++ {
+				g := newEmptyGame(make([]string, 4), width, height, topology, true, seed)
+				spawns := g.placeSpawns(4)
+				checkSpawns(t, g, spawns, 4)
+				distance := func(i int, j int) int {
+					return distancesFrom(topology, width, height, spawns[i], nil)[spawns[j]]
+				}
+				teams := distance(0, 1) + distance(2, 3)
+				if other := distance(0, 2) + distance(1, 3); other < teams {
+					t.Errorf("%s %v, seed %d: teammates are %d apart, but could be %d", name, aspect, seed, teams, other)
+				}
+				if other := distance(0, 3) + distance(1, 2); other < teams {
+					t.Errorf("%s %v, seed %d: teammates are %d apart, but could be %d", name, aspect, seed, teams, other)
+				}
+			}
+		}
+	}
+}
@@ -0,0 +1,115 @@
+// countries.io
+// Copyright (C) 2019 Allen B
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program. If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+// Type gameStats collects statistics about a game for the results screen
+type gameStats struct {
+	Winners    []int `json:"winners"`
+	Eliminated []int `json:"eliminated"` // turn = [countryIndex], -1 if never eliminated
+
+	PeakLand       []uint `json:"peak_land"`
+	PeakSoldiers   []uint `json:"peak_soldiers"`
+	PeakScientists []uint `json:"peak_scientists"`
+
+	// One value per turn
+	Land       [][]uint `json:"land"` // land = [countryIndex][turn]
+	Soldiers   [][]uint `json:"soldiers"`
+	Scientists [][]uint `json:"scientists"`
+
+	Buildings []map[string]int `json:"buildings"` // count = [countryIndex][building]
+}
+
+func newGameStats(countries int) *gameStats {
+	s := &gameStats{
+		Winners:        make([]int, 0),
+		Eliminated:     make([]int, countries),
+		PeakLand:       make([]uint, countries),
+		PeakSoldiers:   make([]uint, countries),
+		PeakScientists: make([]uint, countries),
+		Land:           make([][]uint, countries),
+		Soldiers:       make([][]uint, countries),
+		Scientists:     make([][]uint, countries),
+		Buildings:      make([]map[string]int, countries),
+	}
+	for i := 0; i < countries; i++ {
+		s.Eliminated[i] = -1
+		s.Buildings[i] = make(map[string]int)
+	}
+	return s
+}
+
+// Method Record adds the current turn to the statistics
+func (s *gameStats) Record(g *Game) {
+	land, soldiers, scientists := g.Totals()
+	for country := range g.Countries {
+		s.Land[country] = append(s.Land[country], land[country])
+		s.Soldiers[country] = append(s.Soldiers[country], soldiers[country])
+		s.Scientists[country] = append(s.Scientists[country], scientists[country])
+
+		if land[country] > s.PeakLand[country] {
+			s.PeakLand[country] = land[country]
+		}
+		if soldiers[country] > s.PeakSoldiers[country] {
+			s.PeakSoldiers[country] = soldiers[country]
+		}
+		if scientists[country] > s.PeakScientists[country] {
+			s.PeakScientists[country] = scientists[country]
+		}
+	}
+	s.checkEliminated(g)
+}
+
+// Method clone returns a copy that doesn't change as the game goes on.
+// Per-turn values are only ever appended to, so those slices can be shared.
+func (s *gameStats) clone() *gameStats {
+	c := *s
+	c.Winners = append([]int(nil), s.Winners...)
+	c.Eliminated = append([]int(nil), s.Eliminated...)
+	c.PeakLand = append([]uint(nil), s.PeakLand...)
+	c.PeakSoldiers = append([]uint(nil), s.PeakSoldiers...)
+	c.PeakScientists = append([]uint(nil), s.PeakScientists...)
+	c.Land = append([][]uint(nil), s.Land...)
+	c.Soldiers = append([][]uint(nil), s.Soldiers...)
+	c.Scientists = append([][]uint(nil), s.Scientists...)
+	c.Buildings = make([]map[string]int, len(s.Buildings))
+	for country, buildings := range s.Buildings {
+		c.Buildings[country] = make(map[string]int, len(buildings))
+		for building, count := range buildings {
+			c.Buildings[country][building] = count
+		}
+	}
+	return &c
+}
+
+// Method Built counts a building made by a country
+func (s *gameStats) Built(countryIndex int, building string) {
+	s.Buildings[countryIndex][building]++
+}
+
+// Method Finish fills in the results once the game has ended
+func (s *gameStats) Finish(g *Game) {
+	s.checkEliminated(g)
+	s.Winners = g.Winners()
+}
+
+func (s *gameStats) checkEliminated(g *Game) {
+	for loser, _ := range g.Losers {
+		if s.Eliminated[loser] < 0 {
+			s.Eliminated[loser] = g.Turn
+		}
+	}
+}
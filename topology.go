@@ -0,0 +1,203 @@
+// countries.io
+// Copyright (C) 2019 Allen B
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program. If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+// Type Topology decides which tiles of a map are next to each other
+type Topology interface {
+	Name() string
+
+	// Neighbors returns the tiles an army can move to in one step
+	Neighbors(width int, height int, tile int) []int
+
+	// TilesAround returns the tiles at most r steps away, including the tile itself
+	TilesAround(width int, height int, tile int, r int) []int
+}
+
+var topologies = map[string]Topology{
+	"square": squareTopology{},
+	"hex":    hexTopology{},
+	"torus":  torusTopology{},
+}
+
+// A square grid with edges
+type squareTopology struct{}
+
+func (squareTopology) Name() string { return "square" }
+
+func (squareTopology) Neighbors(width int, height int, tile int) []int {
+	out := make([]int, 0, 4)
+	row, col := tile/width, tile%width
+	if row > 0 {
+		out = append(out, tile-width)
+	}
+	if row < height-1 {
+		out = append(out, tile+width)
+	}
+	if col > 0 {
+		out = append(out, tile-1)
+	}
+	if col < width-1 {
+		out = append(out, tile+1)
+	}
+	return out
+}
+
+func (squareTopology) TilesAround(width int, height int, tile int, r int) []int {
+	out := make([]int, 0)
+	tileCol := tile % width
+	tileRow := tile / width
+	startCol := tileCol - r
+	endCol := tileCol + r
+	startRow := tileRow - r
+	endRow := tileRow + r
+
+	if startCol < 0 {
+		startCol = 0
+	}
+	if endCol > width-1 {
+		endCol = width - 1
+	}
+	if startRow < 0 {
+		startRow = 0
+	}
+	if endRow > height-1 {
+		endRow = height - 1
+	}
+
+	for row := startRow; row <= endRow; row++ {
+		for col := startCol; col <= endCol; col++ {
+			out = append(out, row*width+col)
+		}
+	}
+
+	return out
+}
+
+// A square grid where the edges wrap around
+type torusTopology struct{}
+
+func (torusTopology) Name() string { return "torus" }
+
+func (torusTopology) Neighbors(width int, height int, tile int) []int {
+	row, col := tile/width, tile%width
+	return []int{
+		(row+height-1)%height*width + col,
+		(row+1)%height*width + col,
+		row*width + (col+width-1)%width,
+		row*width + (col+1)%width,
+	}
+}
+
+func (torusTopology) TilesAround(width int, height int, tile int, r int) []int {
+	out := make([]int, 0)
+	tileRow, tileCol := tile/width, tile%width
+
+	// Don't go around more than once
+	rowR, colR := r, r
+	if 2*rowR+1 > height {
+		rowR = height / 2
+	}
+	if 2*colR+1 > width {
+		colR = width / 2
+	}
+
+	seen := make(map[int]bool)
+	for dRow := -rowR; dRow <= rowR; dRow++ {
+		for dCol := -colR; dCol <= colR; dCol++ {
+			row := ((tileRow+dRow)%height + height) % height
+			col := ((tileCol+dCol)%width + width) % width
+			index := row*width + col
+			if !seen[index] {
+				seen[index] = true
+				out = append(out, index)
+			}
+		}
+	}
+	return out
+}
+
+// A hexagonal grid where odd rows are shifted right by half a tile
+type hexTopology struct{}
+
+func (hexTopology) Name() string { return "hex" }
+
+func (hexTopology) Neighbors(width int, height int, tile int) []int {
+	out := make([]int, 0, 6)
+	row, col := tile/width, tile%width
+
+	// Columns of the tiles above and below
+	left, right := col-1, col
+	if row%2 == 1 {
+		left, right = col, col+1
+	}
+
+	add := func(row int, col int) {
+		if row >= 0 && row < height && col >= 0 && col < width {
+			out = append(out, row*width+col)
+		}
+	}
+	add(row, col-1)
+	add(row, col+1)
+	add(row-1, left)
+	add(row-1, right)
+	add(row+1, left)
+	add(row+1, right)
+	return out
+}
+
+func (hexTopology) TilesAround(width int, height int, tile int, r int) []int {
+	out := make([]int, 0)
+	tileRow, tileCol := tile/width, tile%width
+	for row := tileRow - r; row <= tileRow+r; row++ {
+		if row < 0 || row >= height {
+			continue
+		}
+		for col := tileCol - r - 1; col <= tileCol+r+1; col++ {
+			if col < 0 || col >= width {
+				continue
+			}
+			if hexDistance(tileRow, tileCol, row, col) <= r {
+				out = append(out, row*width+col)
+			}
+		}
+	}
+	return out
+}
+
+// Returns the number of steps between two tiles of a hex grid
+func hexDistance(row1 int, col1 int, row2 int, col2 int) int {
+	// Convert to cube coordinates
+	x1 := col1 - (row1-(row1&1))/2
+	x2 := col2 - (row2-(row2&1))/2
+	dx := abs(x1 - x2)
+	dz := abs(row1 - row2)
+	dy := abs((-x1 - row1) - (-x2 - row2))
+	if dx > dz && dx > dy {
+		return dx
+	}
+	if dz > dy {
+		return dz
+	}
+	return dy
+}
+
+func abs(n int) int {
+	if n < 0 {
+		return -n
+	}
+	return n
+}
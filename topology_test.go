@@ -0,0 +1,138 @@
+// countries.io
+// Copyright (C) 2019 Allen B
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program. If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"reflect"
+	"sort"
+	"testing"
+)
+
+// Returns the tiles sorted, so they can be compared as a set
+func sortedTiles(tiles []int) []int {
+	out := append([]int(nil), tiles...)
+	sort.Ints(out)
+	return out
+}
+
+func TestNeighbors(t *testing.T) {
+	tests := []struct {
+		name     string
+		topology Topology
+		width    int
+		height   int
+		tile     int
+		want     []int
+	}{
+		{"square middle", squareTopology{}, 5, 5, 12, []int{7, 11, 13, 17}},
+		{"square corner", squareTopology{}, 5, 5, 0, []int{1, 5}},
+		{"square bottom edge", squareTopology{}, 5, 5, 22, []int{17, 21, 23}},
+
+		// Odd rows are shifted right, so even rows reach up and down to the left
+		// and odd rows to the right
+		{"hex even row", hexTopology{}, 5, 5, 2*5 + 2, []int{6, 7, 11, 13, 16, 17}},
+		{"hex odd row", hexTopology{}, 5, 5, 1*5 + 2, []int{2, 3, 6, 8, 12, 13}},
+		{"hex top left corner", hexTopology{}, 5, 5, 0, []int{1, 5}},
+		{"hex odd row left edge", hexTopology{}, 5, 5, 1 * 5, []int{0, 1, 6, 10, 11}},
+		{"hex odd row right edge", hexTopology{}, 5, 5, 1*5 + 4, []int{4, 8, 14}},
+		{"hex even row right edge", hexTopology{}, 5, 5, 2*5 + 4, []int{8, 9, 13, 18, 19}},
+		{"hex bottom right corner", hexTopology{}, 5, 5, 24, []int{18, 19, 23}},
+
+		{"torus middle", torusTopology{}, 5, 4, 1*5 + 2, []int{2, 6, 8, 12}},
+		{"torus top left corner", torusTopology{}, 5, 4, 0, []int{1, 4, 5, 15}},
+		{"torus bottom right corner", torusTopology{}, 5, 4, 19, []int{4, 14, 15, 18}},
+	}
+	for _, test := range tests {
+		got := sortedTiles(test.topology.Neighbors(test.width, test.height, test.tile))
+		if !reflect.DeepEqual(got, test.want) {
+			t.Errorf("%s: got %v, want %v", test.name, got, test.want)
+		}
+	}
+}
+
+func TestHexDistance(t *testing.T) {
+	tests := []struct {
+		row1, col1, row2, col2 int
+		want                   int
+	}{
+		{0, 0, 0, 0, 0},
+		{0, 0, 0, 3, 3},
+		{0, 0, 1, 0, 1},
+		{1, 0, 0, 1, 1},
+		{0, 0, 2, 0, 2},
+		{0, 0, 2, 1, 2},
+		{0, 0, 2, 2, 3},
+		{0, 0, 3, 3, 5},
+		{3, 3, 0, 0, 5},
+		{1, 4, 4, 0, 6},
+	}
+	for _, test := range tests {
+		if got := hexDistance(test.row1, test.col1, test.row2, test.col2); got != test.want {
+			t.Errorf("hexDistance(%d, %d, %d, %d) = %d, want %d",
+				test.row1, test.col1, test.row2, test.col2, got, test.want)
+		}
+	}
+}
+
+// Neighbours go both ways, and on hex maps TilesAround agrees with walking over the map.
+// Square and torus maps count a diagonal as one step in TilesAround, so they don't.
+func TestNeighborsMatchTilesAround(t *testing.T) {
+	for name, topology := range topologies {
+		for _, size := range [][2]int{{7, 6}, {6, 7}, {3, 3}} {
+			width, height := size[0], size[1]
+			for tile := 0; tile < width*height; tile++ {
+				for _, neighbor := range topology.Neighbors(width, height, tile) {
+					found := false
+					for _, back := range topology.Neighbors(width, height, neighbor) {
+						found = found || back == tile
+					}
+					if !found {
+						t.Errorf("%s %dx%d: %d is next to %d but not the other way", name, width, height, neighbor, tile)
+					}
+				}
+				if name != "hex" {
+					continue
+				}
+
+				distances := distancesFrom(topology, width, height, tile, nil)
+				for _, r := range []int{0, 1, 2, 5} {
+					want := make([]int, 0)
+					for other, distance := range distances {
+						if distance <= r {
+							want = append(want, other)
+						}
+					}
+					got := sortedTiles(topology.TilesAround(width, height, tile, r))
+					if !reflect.DeepEqual(got, want) {
+						t.Errorf("%s %dx%d: tiles %d around %d are %v, want %v", name, width, height, r, tile, got, want)
+					}
+				}
+			}
+		}
+	}
+}
+
+func TestTorusTilesAroundWrapsOnce(t *testing.T) {
+	got := sortedTiles(torusTopology{}.TilesAround(3, 3, 4, 5))
+	if want := []int{0, 1, 2, 3, 4, 5, 6, 7, 8}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want every tile once", got)
+	}
+	got = sortedTiles(torusTopology{}.TilesAround(5, 5, 0, 1))
+	if want := []int{0, 1, 4, 5, 6, 9, 20, 21, 24}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+}
@@ -0,0 +1,103 @@
+// countries.io
+// Copyright (C) 2019 Allen B
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program. If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"fmt"
+)
+
+// Type countryTotals is what a country has, kept up to date as the map changes
+// so nothing has to scan the whole map to find out
+type countryTotals struct {
+	Land       uint
+	Soldiers   uint
+	Scientists uint
+
+	Buildings [buildingTypeCount]int // count = [buildingType]
+}
+
+// Set by -debug-checks. Makes every turn check the totals and the tile type index
+// against the map and panic if they don't match.
+var debugChecks = false
+
+// Adds or takes away what a tile counts for from its owner's totals
+func (g *Game) countTile(tile int, sign int) {
+	country := g.Terrain[tile]
+	if country < 0 {
+		return
+	}
+	t := &g.totals[country]
+	army := g.Armies[tile]
+	scientists := g.kind(tile).Scientists
+	if sign > 0 {
+		t.Land++
+		if scientists {
+			t.Scientists += army
+		} else {
+			t.Soldiers += army
+		}
+	} else {
+		t.Land--
+		if scientists {
+			t.Scientists -= army
+		} else {
+			t.Soldiers -= army
+		}
+	}
+	t.Buildings[g.Buildings[tile].Type] += sign
+}
+
+// Method setArmies changes the armies on a tile
+func (g *Game) setArmies(tile int, army uint) {
+	country := g.Terrain[tile]
+	if country >= 0 {
+		if g.kind(tile).Scientists {
+			g.totals[country].Scientists += army - g.Armies[tile]
+		} else {
+			g.totals[country].Soldiers += army - g.Armies[tile]
+		}
+	}
+	g.Armies[tile] = army
+}
+
+// Method rebuildTotals counts everything from scratch
+func (g *Game) rebuildTotals() {
+	g.totals = make([]countryTotals, len(g.Countries))
+	for tile := range g.Terrain {
+		g.countTile(tile, 1)
+	}
+}
+
+// Method checkConsistency returns an error if the totals or the tile type index
+// don't match the map
+func (g *Game) checkConsistency() error {
+	old := g.totals
+	g.rebuildTotals()
+	actual := g.totals
+	g.totals = old
+	for country := range actual {
+		if old[country] != actual[country] {
+			return fmt.Errorf("turn %d: totals of country %d are %+v, should be %+v", g.Turn, country, old[country], actual[country])
+		}
+	}
+	for tile, tileType := range g.tileTypes {
+		if actual := g.findTileType(tile); tileType != actual {
+			return fmt.Errorf("turn %d: tile %d has type %d, should be %d", g.Turn, tile, tileType, actual)
+		}
+	}
+	return nil
+}
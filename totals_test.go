@@ -0,0 +1,172 @@
+// countries.io
+// Copyright (C) 2019 Allen B
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program. If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"math/rand"
+	"testing"
+)
+
+// Every comeback rule, so rebels, camps and rebuilt capitals all happen
+var allRules = Rules{RebuildCapital: true, Rebels: true, GrowthPenalty: true, Barbarians: true}
+
+// Fails the test if the totals or tile types don't match the map
+func checkTotals(t *testing.T, g *Game, after string) {
+	t.Helper()
+	if err := g.checkConsistency(); err != nil {
+		t.Fatalf("after %s: %v", after, err)
+	}
+}
+
+// Returns a tile of a country that has a building, or -1
+func ownBuilding(g *Game, country int, buildingType BuildingType) int {
+	for _, tile := range g.buildingTiles(buildingType) {
+		if g.Terrain[tile] == country {
+			return tile
+		}
+	}
+	return -1
+}
+
+// Plays seeded bot games that attack, build, launch and relocate, checking the
+// totals after every tick and turn
+func TestTotalsBotGames(t *testing.T) {
+	for seed := int64(1); seed <= 4; seed++ {
+		countries := []string{"bot0", "bot1", "bot2", "bot3"}
+		width, height := mapDimensions(len(countries), "small", 1)
+		g := NewGame(countries, width, height, squareTopology{}, false, seed)
+		g.Rules = allRules
+		g.PlaceCamps(len(countries))
+		random := rand.New(rand.NewSource(seed))
+		checkTotals(t, g, "the start")
+
+		for g.Turn < 600 && !g.Ended() {
+			for tick := 0; tick < 2; tick++ {
+				for country := range g.Countries {
+					if g.Losers[country] {
+						continue
+					}
+					botMove(g, country, random)
+
+					// Everything else a player can do, on a random tile
+					tile := random.Intn(len(g.Terrain))
+					g.Gold[country] += 10
+					switch random.Intn(6) {
+					case 0:
+						g.MakeWall(country, tile)
+					case 1:
+						g.MakePortal(country, tile)
+					case 2:
+						g.Collect(country, tile)
+					case 3:
+						g.MakeLauncher(country, tile)
+					case 4:
+						if city := ownBuilding(g, country, BUILDING_CITY); city >= 0 {
+							g.Relocate(country, city)
+						}
+					case 5:
+						if launcher := ownBuilding(g, country, BUILDING_LAUNCHER); launcher >= 0 {
+							g.Attack(country, launcher, tile, false)
+						}
+					}
+				}
+				checkTotals(t, g, "a tick")
+			}
+			g.NextTurn()
+			checkTotals(t, g, "a turn")
+		}
+	}
+}
+
+func TestTotalsCaptureAndRelocate(t *testing.T) {
+	g := crowdedGame(30, 2)
+	g.Rules = allRules
+	checkTotals(t, g, "the start")
+
+	// Country 0 takes country 1's capital from next door
+	capital := ownBuilding(g, 1, BUILDING_CAPITAL)
+	from := g.Neighbors(capital)[0]
+	g.setTerrain(from, 0)
+	g.setArmies(from, 100000)
+	checkTotals(t, g, "setting up the attack")
+	if !g.Attack(0, from, capital, false) {
+		t.Fatal("the attack on the capital failed")
+	}
+	checkTotals(t, g, "capturing a capital")
+	if g.HasCapital(1) {
+		t.Fatal("country 1 still has a capital")
+	}
+
+	// Country 1 moves its capital to one of its cities
+	for turn := 0; turn < 10; turn++ {
+		g.NextTurn()
+		checkTotals(t, g, "a turn without a capital")
+	}
+	city := ownBuilding(g, 1, BUILDING_CITY)
+	if city < 0 {
+		t.Fatal("country 1 has no cities")
+	}
+	g.Gold[1] = costRelocate
+	if !g.Relocate(1, city) {
+		t.Fatal("relocating failed")
+	}
+	checkTotals(t, g, "relocating")
+	if !g.HasCapital(1) {
+		t.Fatal("country 1 has no capital after relocating")
+	}
+}
+
+func TestTotalsRebuildCapital(t *testing.T) {
+	g := crowdedGame(30, 2)
+	g.Rules = allRules
+	capital := ownBuilding(g, 1, BUILDING_CAPITAL)
+	from := g.Neighbors(capital)[0]
+	g.setTerrain(from, 0)
+	g.setArmies(from, 100000)
+	g.Attack(0, from, capital, false)
+
+	for turn := 0; turn <= capitalRebuildTurns+1; turn++ {
+		g.NextTurn()
+		checkTotals(t, g, "a turn")
+	}
+	if !g.HasCapital(1) {
+		t.Fatal("country 1 didn't get a new capital")
+	}
+}
+
+func TestTotalsRebels(t *testing.T) {
+	g := crowdedGame(30, 4)
+	g.Rules = allRules
+
+	// Country 0 takes most of the map, which is what brings out rebels
+	for tile, country := range g.Terrain {
+		if country > 0 && !g.TileSpecial(tile) && tile%4 != 0 {
+			g.setTerrain(tile, 0)
+		}
+	}
+	checkTotals(t, g, "growing country 0")
+
+	land, _, _ := g.Totals()
+	before := land[0]
+	g.Turn = rebelInterval
+	g.NextTurn()
+	checkTotals(t, g, "rebels")
+	land, _, _ = g.Totals()
+	if land[0] >= before {
+		t.Fatalf("country 0 has %d tiles after rebels, had %d", land[0], before)
+	}
+}
@@ -17,6 +17,9 @@
 package main
 
 import (
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"log"
 	"strconv"
@@ -27,7 +30,40 @@ import (
 	"github.com/gorilla/websocket"
 )
 
-var games = make(map[string]*Game)
+// Running games and their threads, by id
+var games = struct {
+	Map     map[string]*Game
+	Threads map[string]gameThread
+	sync.Mutex
+}{
+	Map:     make(map[string]*Game),
+	Threads: make(map[string]gameThread),
+}
+
+// Returns a running game and its thread
+func getGame(gameId string) (*Game, gameThread, bool) {
+	games.Lock()
+	defer games.Unlock()
+	game, ok := games.Map[gameId]
+	thread, hasThread := games.Threads[gameId]
+	return game, thread, ok && hasThread
+}
+
+// Adds a game that's about to run. The thread has to exist before players are told to join it.
+func addGame(gameId string, game *Game, thread gameThread) {
+	games.Lock()
+	games.Map[gameId] = game
+	games.Threads[gameId] = thread
+	games.Unlock()
+}
+
+// Forgets a game that ended
+func removeGame(gameId string) {
+	games.Lock()
+	delete(games.Map, gameId)
+	delete(games.Threads, gameId)
+	games.Unlock()
+}
 
 type gameConnInfo struct {
 	Game  string
@@ -42,6 +78,7 @@ var gameConns = struct {
 }
 
 func broadcastGame(gameId string, message string) {
+	start := time.Now()
 	gameConns.Lock()
 	for conn, info := range gameConns.Map {
 		if info.Game == gameId {
@@ -49,12 +86,48 @@ func broadcastGame(gameId string, message string) {
 		}
 	}
 	gameConns.Unlock()
+	metrics.BroadcastDuration.Observe(time.Since(start).Seconds())
+	metrics.MessageSize.Observe(float64(len(message)))
+}
+
+// Sends a message to one connection. Every write to a game connection holds gameConns,
+// since the game thread can be writing to it at the same time.
+func sendGame(conn *websocket.Conn, message string) {
+	gameConns.Lock()
+	conn.WriteMessage(websocket.TextMessage, []byte(message))
+	gameConns.Unlock()
+}
+
+// Sends a message to the connection playing as a country
+func sendCountry(gameId string, countryIndex int, message string) {
+	gameConns.Lock()
+	for conn, info := range gameConns.Map {
+		if info.Game == gameId && info.Index == countryIndex {
+			conn.WriteMessage(websocket.TextMessage, []byte(message))
+		}
+	}
+	gameConns.Unlock()
+}
+
+// Sends a message to every connection on a country's team
+func broadcastTeam(gameId string, game *Game, countryIndex int, message string) {
+	gameConns.Lock()
+	for conn, info := range gameConns.Map {
+		if info.Game == gameId && info.Index >= 0 && game.IsSameTeam(info.Index, countryIndex) {
+			conn.WriteMessage(websocket.TextMessage, []byte(message))
+		}
+	}
+	gameConns.Unlock()
 }
 
 type gameThread struct {
 	// Outgoing
 	Error []chan string
 
+	// What each player has to send to join as their country. Players get it with
+	// the start message, so nobody else can take their place.
+	Secrets []string
+
 	// Incoming
 	Join chan struct {
 		int
@@ -68,14 +141,43 @@ type gameThread struct {
 	MakePortal   [](chan int)
 	Collect      [](chan int)
 	MakeLauncher [](chan int)
+	Relocate     [](chan int)
+	Pause        [](chan bool)
+	Diplomacy    [](chan diplomacyAction)
+	Research     [](chan string)
+
+	// Requests from the admin API
+	Admin chan adminRequest
 }
 
-var gameThreads = make(map[string]gameThread)
+// Type diplomacyAction is a propose, accept, decline or break command
+type diplomacyAction struct {
+	Action  string
+	Country int
+	Pact    int
+}
+
+// Type gameSettings holds the room settings a game is played with
+type gameSettings struct {
+	// The room the game was started from
+	Mode string
+
+	// Length of a tick. A turn is two ticks long.
+	Tick time.Duration
+
+	// Country index of the host of a custom room, or -1
+	Host int
+}
 
 func handleGameCommand(conn *websocket.Conn, mt int, args []string) {
 	if mt != websocket.CloseMessage && len(args) == 0 {
 		return
 	}
+	if mt == websocket.CloseMessage {
+		metrics.GameCommands.Inc("close")
+	} else {
+		metrics.GameCommands.Inc(commandLabel(args[0], gameCommandNames))
+	}
 	if mt == websocket.TextMessage && args[0] == "join" {
 		gameConns.Lock()
 		_, ok := gameConns.Map[conn]
@@ -83,28 +185,49 @@ func handleGameCommand(conn *websocket.Conn, mt int, args []string) {
 		if ok {
 			return
 		}
-		if len(args) < 3 {
+		if len(args) != 3 && len(args) != 4 {
 			return
 		}
 		gameId := args[1]
 
 		index, err := strconv.Atoi(args[2])
 		if err != nil {
-			conn.WriteMessage(websocket.TextMessage, []byte("error "+err.Error()))
+			sendGame(conn, "error "+err.Error())
 			return
 		}
 
-		thread, ok := gameThreads[gameId]
+		game, thread, ok := getGame(gameId)
 		if !ok {
-			conn.WriteMessage(websocket.TextMessage, []byte("error game doesn't exist"))
+			sendGame(conn, "error game doesn't exist")
+			return
+		}
+		if index < -1 || index >= len(thread.Error) {
+			sendGame(conn, "error no such country")
+			return
+		}
+		// Only the player themself can take over their country from another connection
+		if index >= 0 && (len(args) != 4 || subtle.ConstantTimeCompare([]byte(args[3]), []byte(thread.Secrets[index])) != 1) {
+			sendGame(conn, "error that country belongs to somebody else")
+			return
+		}
+		name := ""
+		if index >= 0 {
+			name = game.Countries[index]
+		}
+		if bans.Banned(name, connIP(conn)) {
+			sendGame(conn, "error you are banned")
+			return
 		}
 		thread.Join <- struct {
 			int
 			*websocket.Conn
 		}{index, conn}
+		if index < 0 {
+			return
+		}
 		select {
 		case err := <-thread.Error[index]:
-			conn.WriteMessage(websocket.TextMessage, []byte("error "+err))
+			sendGame(conn, "error "+err)
 		case <-time.After(500 * time.Millisecond):
 		}
 		return
@@ -112,8 +235,12 @@ func handleGameCommand(conn *websocket.Conn, mt int, args []string) {
 
 	gameConns.Lock()
 	info, ok := gameConns.Map[conn]
+	if mt == websocket.CloseMessage {
+		delete(gameConns.Map, conn)
+	}
 	gameConns.Unlock()
-	if !ok {
+	// Players who disconnect keep their country, so they can come back with their secret
+	if !ok || mt == websocket.CloseMessage {
 		return
 	}
 
@@ -122,67 +249,207 @@ func handleGameCommand(conn *websocket.Conn, mt int, args []string) {
 		return
 	}
 
-	game, ok := games[info.Game]
+	game, thread, ok := getGame(info.Game)
 	if !ok {
 		return
 	}
-	thread := gameThreads[info.Game]
 
-	if mt == websocket.CloseMessage {
-		game.Leave(info.Index)
+	command, err := parseGameCommand(args, game)
+	if err != nil {
+		metrics.DroppedCommands.Inc("invalid")
+		logDebug("invalid command from " + connIP(conn) + ": " + err.Error())
 		return
 	}
 
-	switch args[0] {
+	switch command.Name {
 	case "attack":
-		if len(args) < 4 {
-			return
-		}
-		fromTile, err1 := strconv.Atoi(args[1])
-		toTile, err2 := strconv.Atoi(args[2])
-		if err1 != nil || err2 != nil {
-			log.Println("Error: ", err1, " or ", err2)
-		}
-
 		isHalf := 0
-		if args[3] == "1" {
+		if command.Half {
 			isHalf = 1
 		}
-
 		select {
-		case thread.Attack[info.Index] <- [3]int{fromTile, toTile, isHalf}:
-		case <-time.After(300 * time.Millisecond):
+		case thread.Attack[info.Index] <- [3]int{command.From, command.To, isHalf}:
+		case <-time.After(actionTimeout):
+			metrics.DroppedCommands.Inc("full")
+		}
+	case "city", "wall", "school", "portal", "collect", "launcher", "relocate":
+		select {
+		case thread.buildChannels()[command.Name][info.Index] <- command.To:
+		case <-time.After(actionTimeout):
+			metrics.DroppedCommands.Inc("full")
+		}
+	case "propose", "accept", "decline", "break":
+		action := diplomacyAction{Action: command.Name, Country: command.Country, Pact: command.Pact}
+		select {
+		case thread.Diplomacy[info.Index] <- action:
+		case <-time.After(actionTimeout):
+			metrics.DroppedCommands.Inc("full")
 		}
-	case "city", "wall", "school", "portal", "collect", "launcher":
-		if len(args) != 2 {
+	case "research":
+		select {
+		case thread.Research[info.Index] <- command.Tech:
+		case <-time.After(actionTimeout):
+			metrics.DroppedCommands.Inc("full")
+		}
+	case "pause", "unpause":
+		select {
+		case thread.Pause[info.Index] <- command.Name == "pause":
+		case <-time.After(actionTimeout):
+			metrics.DroppedCommands.Inc("full")
+		}
+	case "chat", "chat_team":
+		team := command.Name == "chat_team"
+		if team && !game.Is2v2 {
+			sendGame(conn, "chat_error there are no teams")
+			return
+		}
+		text, err := chatText(conn, command.Text)
+		if err == errEmptyChat {
 			return
 		}
-		tile, err := strconv.Atoi(args[1])
 		if err != nil {
-			log.Println(err)
+			sendGame(conn, "chat_error "+err.Error())
+			return
 		}
-		channel := map[string](chan int){
-			"city":     thread.MakeCity[info.Index],
-			"wall":     thread.MakeWall[info.Index],
-			"school":   thread.MakeSchool[info.Index],
-			"portal":   thread.MakePortal[info.Index],
-			"collect":  thread.Collect[info.Index],
-			"launcher": thread.MakeLauncher[info.Index],
-		}[args[0]]
 
-		channel <- tile
+		chatLogs.Lock()
+		chatLogs.Map[info.Game] = append(chatLogs.Map[info.Game], chatMessage{
+			Turn:    game.Turn,
+			Country: info.Index,
+			Team:    team,
+			Text:    text,
+		})
+		chatLogs.Unlock()
+
+		message := command.Name + " " + fmt.Sprint(info.Index) + " " + text
+		if team {
+			broadcastTeam(info.Game, game, info.Index, message)
+		} else {
+			broadcastGame(info.Game, message)
+		}
 	case "surrender":
 		game.Leave(info.Index)
 	}
 }
 
-func startGameThread(gameId string, game *Game) {
-	thread := gameThread{}
+// The commands that take a tile, in the order each tick plays them
+var buildCommands = []string{"wall", "city", "school", "portal", "collect", "launcher", "relocate"}
+
+// Returns the channels of the commands that take a tile
+func (thread gameThread) buildChannels() map[string][](chan int) {
+	return map[string][](chan int){
+		"city":     thread.MakeCity,
+		"wall":     thread.MakeWall,
+		"school":   thread.MakeSchool,
+		"portal":   thread.MakePortal,
+		"collect":  thread.Collect,
+		"launcher": thread.MakeLauncher,
+		"relocate": thread.Relocate,
+	}
+}
+
+// Takes the actions waiting in the buffered channels. They're played from the
+// thread state before anything sent after them.
+func (thread gameThread) takePending() pendingActions {
+	p := pendingActions{Builds: make(map[string][][]int)}
+	for command, channels := range thread.buildChannels() {
+		p.Builds[command] = make([][]int, len(channels))
+		for countryIndex, channel := range channels {
+			tiles := make([]int, 0)
+		loop:
+			for {
+				select {
+				case tile := <-channel:
+					tiles = append(tiles, tile)
+				default:
+					break loop
+				}
+			}
+			p.Builds[command][countryIndex] = tiles
+		}
+	}
+	p.Diplomacy = make([][]diplomacyAction, len(thread.Diplomacy))
+	for countryIndex, channel := range thread.Diplomacy {
+		actions := make([]diplomacyAction, 0)
+	loopdiplomacy:
+		for {
+			select {
+			case action := <-channel:
+				actions = append(actions, action)
+			default:
+				break loopdiplomacy
+			}
+		}
+		p.Diplomacy[countryIndex] = actions
+	}
+	p.Research = make([][]string, len(thread.Research))
+	for countryIndex, channel := range thread.Research {
+		techs := make([]string, 0)
+	loopresearch:
+		for {
+			select {
+			case tech := <-channel:
+				techs = append(techs, tech)
+			default:
+				break loopresearch
+			}
+		}
+		p.Research[countryIndex] = techs
+	}
+	return p
+}
+
+// Discards everything waiting in the action channels
+func (thread gameThread) drainActions() {
+	for _, channel := range thread.Attack {
+		select {
+		case <-channel:
+		default:
+		}
+	}
+	for _, channel := range thread.Diplomacy {
+	loopdiplomacy:
+		for {
+			select {
+			case <-channel:
+			default:
+				break loopdiplomacy
+			}
+		}
+	}
+	for _, channel := range thread.Research {
+	loopresearch:
+		for {
+			select {
+			case <-channel:
+			default:
+				break loopresearch
+			}
+		}
+	}
+	for _, channels := range [][](chan int){thread.MakeCity, thread.MakeWall, thread.MakeSchool, thread.MakePortal, thread.Collect, thread.MakeLauncher, thread.Relocate} {
+		for _, channel := range channels {
+		loop:
+			for {
+				select {
+				case <-channel:
+				default:
+					break loop
+				}
+			}
+		}
+	}
+}
+
+func newGameThread(secrets []string) gameThread {
+	countries := len(secrets)
+	thread := gameThread{Secrets: secrets}
 	thread.Join = make(chan struct {
 		int
 		*websocket.Conn
 	})
-	for _, _ = range game.Countries {
+	thread.Admin = make(chan adminRequest)
+	for i := 0; i < countries; i++ {
 		thread.Error = append(thread.Error, make(chan string))
 		thread.Attack = append(thread.Attack, make(chan [3]int))
 		thread.MakeCity = append(thread.MakeCity, make(chan int, 16))
@@ -191,48 +458,309 @@ func startGameThread(gameId string, game *Game) {
 		thread.MakePortal = append(thread.MakePortal, make(chan int, 16))
 		thread.Collect = append(thread.Collect, make(chan int, 16))
 		thread.MakeLauncher = append(thread.MakeLauncher, make(chan int, 16))
+		thread.Relocate = append(thread.Relocate, make(chan int, 16))
+		thread.Pause = append(thread.Pause, make(chan bool))
+		thread.Diplomacy = append(thread.Diplomacy, make(chan diplomacyAction, 16))
+		thread.Research = append(thread.Research, make(chan string, 16))
 	}
+	return thread
+}
 
-	gameThreads[gameId] = thread
-
-	n := 1
-	// wait for all to join
-	for n <= len(game.Countries) {
-		data := <-thread.Join
-		index := data.int
-		conn := data.Conn
+// Function newSecrets returns a join secret for each country
+func newSecrets(countries int) ([]string, error) {
+	secrets := make([]string, countries)
+	for i := range secrets {
+		secret, err := newToken()
+		if err != nil {
+			return nil, err
+		}
+		secrets[i] = secret
+	}
+	return secrets, nil
+}
 
-		if index < 0 {
-			continue
+// Registers a connection as the player of a country, or as a spectator if index is -1.
+// If somebody already plays as that country, they are replaced if replace is true
+// and the join fails otherwise.
+func (thread gameThread) acceptJoin(gameId string, index int, conn *websocket.Conn, replace bool) bool {
+	gameConns.Lock()
+	defer gameConns.Unlock()
+	if index < 0 {
+		gameConns.Map[conn] = gameConnInfo{Game: gameId, Index: index}
+		return true
+	}
+	for other, info := range gameConns.Map {
+		if info.Game == gameId && info.Index == index {
+			if !replace {
+				select {
+				case thread.Error[index] <- "somebody took your place":
+				default:
+				}
+				return false
+			}
+			other.WriteMessage(websocket.TextMessage, []byte("error you joined from somewhere else"))
+			delete(gameConns.Map, other)
+			other.Close()
 		}
+	}
+	gameConns.Map[conn] = gameConnInfo{Game: gameId, Index: index}
+	return true
+}
 
-		// Check if somebody already connected as that player
-		gameConns.Lock()
-		for _, info := range gameConns.Map {
-			if info.Game == gameId && info.Index == index {
-				thread.Error[index] <- "somebody took your place"
-				gameConns.Unlock()
-				continue
+// Waits until every country still in the game has joined, or until timeout if it isn't 0.
+// st is the state of the thread if the game was already running, and nil otherwise.
+// Players who join a running game are sent its state.
+//
+// Returns false if the server is shutting down and the game shouldn't go on.
+func (thread gameThread) waitForPlayers(gameId string, game *Game, settings gameSettings, st *threadState, timeout time.Duration) bool {
+	running := st != nil
+	var deadline <-chan time.Time
+	if timeout > 0 {
+		deadline = time.After(timeout)
+	}
+	joined := make(map[int]bool)
+	for len(joined) < len(game.Countries)-len(game.Losers) {
+		select {
+		case data := <-thread.Join:
+			index := data.int
+			if thread.acceptJoin(gameId, index, data.Conn, running) {
+				if running {
+					sendGameState(data.Conn, game, settings, st.Pause.Paused)
+				}
+				if index >= 0 && !game.Losers[index] {
+					joined[index] = true
+				}
 			}
+		case <-deadline:
+			return true
+		case <-shutdown.Stop:
+			return false
 		}
+	}
+	return true
+}
 
-		gameConns.Map[conn] = gameConnInfo{Game: gameId, Index: index}
-		gameConns.Unlock()
-		n++
+// Returns the messages that tell a player what game they are in
+func gameIntro(game *Game, settings gameSettings) []string {
+	messages := []string{
+		"player_list " + strings.Join(game.Countries, " "),
+		fmt.Sprintf("map %d %d %d %s", game.Width, game.Height, settings.Tick.Nanoseconds()/1e6, game.Topology.Name()),
+		fmt.Sprintf("relocate_cooldown %d", relocateCooldown),
+	}
+	if data, err := marshalTechTree(); err != nil {
+		log.Println(err)
+	} else {
+		messages = append(messages, "tech_tree "+string(data))
+	}
+	return messages
+}
+
+// Sends everything a player joining a running game needs to see it
+func sendGameState(conn *websocket.Conn, game *Game, settings gameSettings, paused bool) {
+	messages := gameIntro(game, settings)
+	if data, err := game.MarshalJSON(nil, nil); err != nil {
+		log.Println(err)
+	} else {
+		messages = append(messages, "update "+string(data))
+	}
+	if game.HasDiplomacy() {
+		if data, err := game.MarshalDiplomacy(); err != nil {
+			log.Println(err)
+		} else {
+			messages = append(messages, "diplomacy "+string(data))
+		}
+	}
+	if paused {
+		messages = append(messages, "paused")
+	}
+
+	gameConns.Lock()
+	defer gameConns.Unlock()
+	for _, message := range messages {
+		conn.WriteMessage(websocket.TextMessage, []byte(message))
+	}
+}
+
+// Type threadState is what a game thread keeps track of besides the game
+type threadState struct {
+	Pause  *pauseState
+	Stats  *gameStats
+	Replay *replay
+	Start  time.Time
+
+	// Updates written to the replay stream
+	Updates int
+
+	// Actions taken out of the channels for a snapshot, played before newer ones
+	Pending pendingActions
+
+	// True if the next tick starts a new turn
+	TurnTick bool
+}
+
+func startGameThread(gameId string, game *Game, settings gameSettings, thread gameThread) {
+	defer runningGames.Done()
+
+	// wait for all to join
+	if !thread.waitForPlayers(gameId, game, settings, nil, 0) {
+		return
 	}
 
-	broadcastGame(gameId, "player_list "+strings.Join(game.Countries, " "))
-	broadcastGame(gameId, fmt.Sprintf("map %d %d", game.Width, game.Height))
-	log.Println("started " + gameId)
+	for _, message := range gameIntro(game, settings) {
+		broadcastGame(gameId, message)
+	}
+	logInfo("started " + gameId)
 
-	ticker := time.NewTicker(250 * time.Millisecond)
+	runGameThread(gameId, game, settings, thread, &threadState{
+		Pause: newPauseState(len(game.Countries), settings.Host),
+		Stats: newGameStats(len(game.Countries)),
+		Replay: &replay{
+			Players:  game.Countries,
+			Width:    game.Width,
+			Height:   game.Height,
+			Topology: game.Topology.Name(),
+			Tick:     settings.Tick.Nanoseconds() / 1e6,
+		},
+		Start:    time.Now(),
+		TurnTick: true,
+	})
+}
+
+// Function resumeGameThread carries on a game from a snapshot
+func resumeGameThread(snapshot *gameSnapshot) error {
+	game, err := snapshot.Game.Game()
+	if err != nil {
+		return err
+	}
+	settings := gameSettings{
+		Mode: snapshot.Mode,
+		Tick: time.Duration(snapshot.Tick) * time.Millisecond,
+		Host: snapshot.Host,
+	}
+	st := &threadState{
+		Pause:    snapshot.Pause,
+		Stats:    snapshot.Stats,
+		Replay:   snapshot.Replay,
+		Updates:  snapshot.Updates,
+		Start:    snapshot.Start,
+		TurnTick: snapshot.TurnTick,
+	}
+	if st.Pause == nil {
+		st.Pause = newPauseState(len(game.Countries), settings.Host)
+	}
+	if st.Pause.Votes == nil {
+		st.Pause.Votes = make(map[int]bool)
+	}
+	// The time spent down doesn't count towards the pause
+	st.Pause.Since = time.Now()
+	if st.Stats == nil {
+		st.Stats = newGameStats(len(game.Countries))
+	}
+	if st.Replay == nil {
+		st.Replay = &replay{
+			Players:  game.Countries,
+			Width:    game.Width,
+			Height:   game.Height,
+			Topology: game.Topology.Name(),
+			Tick:     snapshot.Tick,
+		}
+	}
+
+	st.Pending = snapshot.Pending
+
+	if len(snapshot.Secrets) != len(game.Countries) {
+		return fmt.Errorf("snapshot should have %d join secrets", len(game.Countries))
+	}
+	if !startRunning() {
+		return errors.New("the server is shutting down")
+	}
+	thread := newGameThread(snapshot.Secrets)
+	addGame(snapshot.Id, game, thread)
+	chatLogs.Lock()
+	chatLogs.Map[snapshot.Id] = snapshot.Chat
+	chatLogs.Unlock()
+
+	go func() {
+		defer runningGames.Done()
+		// If the server stops before the game carries on, the snapshot is still there
+		if !thread.waitForPlayers(snapshot.Id, game, settings, st, reconnectTimeout) {
+			return
+		}
+		logInfo("resumed " + snapshot.Id)
+		runGameThread(snapshot.Id, game, settings, thread, st)
+	}()
+	return nil
+}
+
+// Returns a snapshot of a running game. It's a copy, so it can be saved while the game goes on.
+func newSnapshot(gameId string, game *Game, settings gameSettings, thread gameThread, st *threadState) *gameSnapshot {
+	chatLogs.Lock()
+	chat := append([]chatMessage(nil), chatLogs.Map[gameId]...)
+	chatLogs.Unlock()
+	st.Pending = st.Pending.with(thread.takePending())
+	return &gameSnapshot{
+		Version:  snapshotVersion,
+		Id:       gameId,
+		Mode:     settings.Mode,
+		Tick:     settings.Tick.Nanoseconds() / 1e6,
+		Host:     settings.Host,
+		Start:    st.Start,
+		TurnTick: st.TurnTick,
+		Game:     game.state(),
+		Pause:    st.Pause.clone(),
+		Stats:    st.Stats.clone(),
+		Replay:   st.Replay,
+		Updates:  st.Updates,
+		Chat:     chat,
+		Pending:  st.Pending,
+		Secrets:  thread.Secrets,
+	}
+}
+
+// Plays a game until it ends
+func runGameThread(gameId string, game *Game, settings gameSettings, thread gameThread, st *threadState) {
+	ticker := time.NewTicker(settings.Tick)
 	defer ticker.Stop()
 
 	oldterrain := make([]int, 0)
 	oldarmies := make([]uint, 0)
 
-	turn := true
+	pause := st.Pause
+	stats := st.Stats
+	rep := st.Replay
+	start := st.Start
+	lastCheckpoint := time.Now()
+	saver := newCheckpointer()
+	drainStarted := shutdown.Checkpoint
+	checkpointNow := false
+	var tickStart time.Time
+	var timing tickTiming
+	ended := false
+
+	metrics.Games.Add(1)
+	defer metrics.Games.Add(-1)
+
+	// Updates go straight to disk rather than piling up until the game ends
+	var stream *replayStream
+	if history != nil {
+		var err error
+		if stream, err = history.Stream(gameId, st.Updates); err != nil {
+			log.Println(err)
+		}
+	}
+
+	// Send the diplomacy state at the start so clients know pacts are possible
+	diplomacyVersion := game.DiplomacyVersion
+	if game.HasDiplomacy() {
+		diplomacyVersion--
+	}
+
 	for {
+		if !tickStart.IsZero() {
+			timing.Add(time.Since(tickStart))
+			metrics.TickDuration.Observe(timing.Last.Seconds())
+		}
+
 		// broadcast update
 		data, err := game.MarshalJSON(oldterrain, oldarmies)
 		if err != nil {
@@ -240,6 +768,12 @@ func startGameThread(gameId string, game *Game) {
 			continue
 		}
 		broadcastGame(gameId, "update "+string(data))
+		if stream != nil {
+			if err := stream.Add(data); err != nil {
+				log.Println(err)
+			}
+			st.Updates = stream.Count
+		}
 		if len(oldterrain) != len(game.Terrain) {
 			oldterrain = append([]int(nil), game.Terrain...)
 		} else {
@@ -251,97 +785,239 @@ func startGameThread(gameId string, game *Game) {
 			copy(oldarmies, game.Armies)
 		}
 
-		if game.Ended() {
-			delete(games, gameId)
-			delete(gameThreads, gameId)
+		if game.Ended() || ended {
+			stats.Finish(game)
+			if ended {
+				// Ended by an admin, so nobody won
+				stats.Winners = make([]int, 0)
+			}
+			data, err := json.Marshal(stats)
+			if err != nil {
+				log.Println(err)
+			} else {
+				broadcastGame(gameId, "game_over "+string(data))
+			}
+
+			removeGame(gameId)
+			saver.Stop()
+			if snapshots != nil {
+				if err := snapshots.Delete(gameId); err != nil {
+					log.Println(err)
+				}
+			}
+			chatLogs.Lock()
+			rep.Chat = chatLogs.Map[gameId]
+			delete(chatLogs.Map, gameId)
+			chatLogs.Unlock()
+
+			if stream != nil {
+				if err := stream.Close(); err != nil {
+					log.Println(err)
+				}
+				end := time.Now()
+				err := history.Save(&gameRecord{
+					Id:         gameId,
+					Mode:       settings.Mode,
+					Width:      game.Width,
+					Height:     game.Height,
+					Topology:   game.Topology.Name(),
+					Is2v2:      game.Is2v2,
+					Tick:       rep.Tick,
+					Seed:       game.Seed,
+					Rules:      game.Rules,
+					Players:    game.Countries,
+					Winners:    stats.Winners,
+					Eliminated: stats.Eliminated,
+					Turns:      game.Turn,
+					Start:      start,
+					End:        end,
+					Duration:   end.Sub(start).Seconds(),
+				}, rep, stream)
+				if err != nil {
+					log.Println(err)
+				}
+			}
 			// go through gameConnInfos
 			return
 		}
 
-		<-ticker.C
-		if turn {
+		// Save right away when draining starts, in case the process is killed before the game stops
+		select {
+		case <-drainStarted:
+			drainStarted = nil
+			checkpointNow = true
+		default:
+		}
+		if snapshots != nil && (checkpointNow || time.Since(lastCheckpoint) >= checkpointInterval) {
+			lastCheckpoint = time.Now()
+			// The snapshot can't count updates that aren't on disk yet
+			if stream != nil {
+				if err := stream.Flush(); err != nil {
+					log.Println(err)
+				}
+			}
+			if saver.Start(newSnapshot(gameId, game, settings, thread, st)) {
+				checkpointNow = false
+			} else {
+				logDebug("skipped a checkpoint of " + gameId + ", the last one is still being saved")
+			}
+		}
+
+		select {
+		case <-ticker.C:
+			tickStart = time.Now()
+		case <-shutdown.Stop:
+			if stream != nil {
+				if err := stream.Close(); err != nil {
+					log.Println(err)
+				}
+			}
+			saver.Stop()
+			stopGame(gameId, game, settings, thread, st)
+			return
+		}
+
+	loopjoin:
+		for {
+			select {
+			case data := <-thread.Join:
+				// Players have shown their secret, so a new connection is the same player coming back
+				if thread.acceptJoin(gameId, data.int, data.Conn, true) {
+					sendGameState(data.Conn, game, settings, pause.Paused)
+				}
+			default:
+				break loopjoin
+			}
+		}
+
+	loopadmin:
+		for {
+			select {
+			case request := <-thread.Admin:
+				switch request.Action {
+				case "end":
+					ended = true
+				case "kick":
+					game.Leave(request.Country)
+				}
+				request.Reply <- game.status(pause, &timing)
+			default:
+				break loopadmin
+			}
+		}
+		if ended {
+			continue
+		}
+
+		for countryIndex, channel := range thread.Pause {
+			select {
+			case data := <-channel:
+				changed, err := pause.Request(game, countryIndex, data)
+				if err != nil {
+					sendCountry(gameId, countryIndex, "pause_error "+err.Error())
+				} else if !changed && len(pause.Votes) != 0 {
+					broadcastGame(gameId, fmt.Sprintf("pause_vote %d %d", len(pause.Votes), pause.VotesNeeded(game)))
+				}
+				if changed {
+					if pause.Paused {
+						broadcastGame(gameId, "paused")
+					} else {
+						broadcastGame(gameId, "unpaused")
+					}
+				}
+			default:
+			}
+		}
+		if pause.Expired() {
+			pause.set(false)
+			broadcastGame(gameId, "unpaused")
+		}
+		if pause.Paused {
+			thread.drainActions()
+			continue
+		}
+
+		if st.TurnTick {
 			game.NextTurn()
+			stats.Record(game)
 		}
-		turn = !turn
+		st.TurnTick = !st.TurnTick
 
 		// Read attacks
 		for countryIndex, attack := range thread.Attack {
 			select {
 			case data := <-attack:
-				game.Attack(countryIndex, data[0], data[1], data[2] != 0)
+				countAction("attack", game.Attack(countryIndex, data[0], data[1], data[2] != 0))
 			default:
 			}
 		}
 
-		for countryIndex, channel := range thread.MakeWall {
-		loopwall:
-			for {
-				select {
-				case data := <-channel:
-					game.MakeWall(countryIndex, data)
-				default:
-					break loopwall
+		// Actions taken for a snapshot were sent before anything still in the channels
+		for _, command := range buildCommands {
+			for countryIndex, tiles := range st.Pending.Builds[command] {
+				for _, tile := range tiles {
+					playBuild(game, stats, command, countryIndex, tile)
 				}
 			}
 		}
-
-		for countryIndex, channel := range thread.MakeCity {
-		loopcity:
-			for {
-				select {
-				case data := <-channel:
-					game.MakeCity(countryIndex, data)
-				default:
-					break loopcity
-				}
+		for countryIndex, actions := range st.Pending.Diplomacy {
+			for _, action := range actions {
+				playDiplomacy(game, countryIndex, action)
+			}
+		}
+		for countryIndex, techs := range st.Pending.Research {
+			for _, tech := range techs {
+				countAction("research", game.Research(countryIndex, tech))
 			}
 		}
+		st.Pending = pendingActions{}
 
-		for countryIndex, channel := range thread.MakeSchool {
-		loopschool:
-			for {
-				select {
-				case data := <-channel:
-					game.MakeSchool(countryIndex, data)
-				default:
-					break loopschool
+		channels := thread.buildChannels()
+		for _, command := range buildCommands {
+			for countryIndex, channel := range channels[command] {
+			loopbuild:
+				for {
+					select {
+					case data := <-channel:
+						playBuild(game, stats, command, countryIndex, data)
+					default:
+						break loopbuild
+					}
 				}
 			}
 		}
 
-		for countryIndex, channel := range thread.MakePortal {
-		loopportal:
+		for countryIndex, channel := range thread.Diplomacy {
+		loopdiplomacy:
 			for {
 				select {
 				case data := <-channel:
-					game.MakePortal(countryIndex, data)
+					playDiplomacy(game, countryIndex, data)
 				default:
-					break loopportal
+					break loopdiplomacy
 				}
 			}
 		}
 
-		for countryIndex, channel := range thread.Collect {
-		loopcollect:
+		for countryIndex, channel := range thread.Research {
+		loopresearch:
 			for {
 				select {
 				case data := <-channel:
-					game.Collect(countryIndex, data)
+					countAction("research", game.Research(countryIndex, data))
 				default:
-					break loopcollect
+					break loopresearch
 				}
 			}
 		}
 
-		for countryIndex, channel := range thread.MakeLauncher {
-		looplauncher:
-			for {
-				select {
-				case data := <-channel:
-					game.MakeLauncher(countryIndex, data)
-				default:
-					break looplauncher
-				}
+		if game.DiplomacyVersion != diplomacyVersion {
+			diplomacyVersion = game.DiplomacyVersion
+			data, err := game.MarshalDiplomacy()
+			if err != nil {
+				log.Println(err)
+			} else {
+				broadcastGame(gameId, "diplomacy "+string(data))
 			}
 		}
 
@@ -355,3 +1031,46 @@ func startGameThread(gameId string, game *Game) {
 		}
 	}
 }
+
+// Plays a build command, counting what gets built
+func playBuild(game *Game, stats *gameStats, command string, countryIndex int, tile int) {
+	ok := false
+	switch command {
+	case "wall":
+		ok = game.MakeWall(countryIndex, tile)
+	case "city":
+		ok = game.MakeCity(countryIndex, tile)
+	case "school":
+		ok = game.MakeSchool(countryIndex, tile)
+	case "portal":
+		ok = game.MakePortal(countryIndex, tile)
+	case "launcher":
+		ok = game.MakeLauncher(countryIndex, tile)
+	case "collect":
+		countAction(command, game.Collect(countryIndex, tile))
+		return
+	case "relocate":
+		countAction(command, game.Relocate(countryIndex, tile))
+		return
+	}
+	if ok {
+		stats.Built(countryIndex, command)
+	}
+	countAction(command, ok)
+}
+
+// Plays a propose, accept, decline or break command
+func playDiplomacy(game *Game, countryIndex int, data diplomacyAction) {
+	ok := false
+	switch data.Action {
+	case "propose":
+		ok = game.Propose(countryIndex, data.Country, data.Pact)
+	case "accept":
+		ok = game.Accept(countryIndex, data.Country)
+	case "decline":
+		ok = game.Decline(countryIndex, data.Country)
+	case "break":
+		ok = game.Break(countryIndex, data.Country)
+	}
+	countAction(data.Action, ok)
+}
@@ -0,0 +1,65 @@
+// countries.io
+// Copyright (C) 2019 Allen B
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program. If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gorilla/websocket"
+)
+
+// Players who close the page can come back, but players who surrender lose
+func TestDisconnectKeepsCountry(t *testing.T) {
+	game := commandTestGame()
+	addGame("disconnect", game, newGameThread([]string{"secret0", "secret1"}))
+	defer removeGame("disconnect")
+
+	done := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := gameUpgrader.Upgrade(w, r, nil)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		gameConns.Lock()
+		gameConns.Map[conn] = gameConnInfo{Game: "disconnect", Index: 0}
+		gameConns.Unlock()
+		readCommands(conn, gameCommandRate, &gameConns, handleGameCommand)
+		done <- struct{}{}
+	}))
+	defer server.Close()
+	url := "ws" + strings.TrimPrefix(server.URL, "http")
+
+	for _, surrender := range []bool{false, true} {
+		conn, _, err := websocket.DefaultDialer.Dial(url, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if surrender {
+			conn.WriteMessage(websocket.TextMessage, []byte("surrender"))
+		}
+		conn.WriteMessage(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseGoingAway, ""))
+		conn.Close()
+		<-done
+		if game.Losers[0] != surrender {
+			t.Errorf("surrendered %v, lost %v", surrender, game.Losers[0])
+		}
+	}
+}
@@ -17,28 +17,32 @@
 package main
 
 import (
+	"encoding/json"
 	"fmt"
 	"github.com/gorilla/websocket"
+	"log"
 	"math/rand"
 	"strconv"
+	"strings"
 	"sync"
 	"time"
 )
 
 var rooms = make(map[string]*Room)
 
+// The public rooms, by name
+var roomModes = defaultConfig().Modes
+
 // Returns the room. If not found creates one
 func roomsGet(id string) *Room {
 	room, ok := rooms[id]
 	if !ok {
-		switch id {
-		case "1v1":
-			room = NewRoom(2, false)
-		case "2v2":
-			room = NewRoom(4, true)
-		case "ffa":
-			room = NewRoom(6, false)
-		default:
+		if mode, ok := roomModes[id]; ok {
+			room = NewRoom(mode.Players, mode.Is2v2)
+		} else if strings.HasPrefix(id, "custom/") {
+			room = NewRoom(customRoomMax, false)
+			room.Custom = true
+		} else {
 			room = NewRoom(1, false)
 		}
 		rooms[id] = room
@@ -68,7 +72,33 @@ func broadcastRoom(roomId string, message string) {
 	}
 }
 
+// Tells the host of a custom room that they are the host
+func sendRoomHost(roomId string, room *Room) {
+	if !room.Custom {
+		return
+	}
+	for conn, info := range roomConns.Map {
+		if roomId == info.Room && info.Country == room.Host {
+			conn.WriteMessage(websocket.TextMessage, []byte("host"))
+		}
+	}
+}
+
+// Returns the name of the hand-made map a room uses, empty if it generates one
+func roomMapName(room *Room) string {
+	if room.Map == nil {
+		return ""
+	}
+	return room.Map.Name
+}
+
 func handleRoomCommand(conn *websocket.Conn, mt int, args []string) {
+	if mt == websocket.CloseMessage {
+		metrics.RoomCommands.Inc("close")
+	} else if len(args) > 0 {
+		metrics.RoomCommands.Inc(commandLabel(args[0], roomCommandNames))
+	}
+
 	roomConns.Lock()
 	defer roomConns.Unlock()
 	if mt == websocket.CloseMessage {
@@ -85,22 +115,40 @@ func handleRoomCommand(conn *websocket.Conn, mt int, args []string) {
 			delete(roomConns.Map, conn)
 			broadcastRoom(roomId, "player_remove")
 
-			//			log.Println("leave " + roomId + " " + country)
+			logDebug("leave " + roomId + " " + country)
 			if room.StartTime == nil {
 				broadcastRoom(roomId, "time_reset")
 			}
+			sendRoomHost(roomId, room)
 		}
 		return
 	}
 	if mt == websocket.TextMessage && len(args) >= 1 && args[0] == "ping" {
 		conn.WriteMessage(websocket.TextMessage, []byte("pong"))
 	}
-	if mt == websocket.TextMessage && len(args) >= 3 && args[0] == "join" {
+	if mt == websocket.TextMessage && len(args) == 3 && args[0] == "join" {
 		if _, ok := roomConns.Map[conn]; ok {
 			conn.WriteMessage(websocket.TextMessage, []byte("error join error: already in a game"))
 			return
 		}
 
+		if isDraining() {
+			conn.WriteMessage(websocket.TextMessage, []byte("error join error: the server is shutting down, try again later"))
+			return
+		}
+		if !validRoomId(args[1]) {
+			conn.WriteMessage(websocket.TextMessage, []byte("error join error: no such room"))
+			return
+		}
+		if !validCountryName(args[2]) {
+			conn.WriteMessage(websocket.TextMessage, []byte(fmt.Sprintf("error join error: names can be up to %d characters", maxNameLength)))
+			return
+		}
+		if bans.Banned(args[2], connIP(conn)) {
+			conn.WriteMessage(websocket.TextMessage, []byte("error join error: you are banned"))
+			return
+		}
+
 		roomId := args[1]
 		room := roomsGet(roomId)
 		if !room.Add(args[2]) {
@@ -113,6 +161,14 @@ func handleRoomCommand(conn *websocket.Conn, mt int, args []string) {
 			Country: args[2],
 		}
 		conn.WriteMessage(websocket.TextMessage, []byte("player_max "+fmt.Sprint(room.Max)))
+		conn.WriteMessage(websocket.TextMessage, []byte("speed "+fmt.Sprint(room.Speed.Nanoseconds()/1e6)))
+		if data, err := json.Marshal(room.Rules); err == nil {
+			conn.WriteMessage(websocket.TextMessage, []byte("rules "+string(data)))
+		}
+		conn.WriteMessage(websocket.TextMessage, []byte("topology "+room.Topology.Name()))
+		conn.WriteMessage(websocket.TextMessage, []byte("map "+roomMapName(room)))
+		conn.WriteMessage(websocket.TextMessage, []byte("size "+room.Size+" "+room.Aspect))
+		sendRoomHost(roomId, room)
 		if len(room.Countries)-1 > 0 {
 			conn.WriteMessage(websocket.TextMessage, []byte("player_add "+fmt.Sprint(len(room.Countries)-1)))
 		}
@@ -127,7 +183,117 @@ func handleRoomCommand(conn *websocket.Conn, mt int, args []string) {
 			startGame(roomId, room)
 		}
 
-		//		log.Println("join " + args[1] + " " + args[2])
+		logDebug("join " + args[1] + " " + args[2])
+		return
+	}
+	if mt == websocket.TextMessage && len(args) >= 2 && args[0] == "speed" {
+		info, ok := roomConns.Map[conn]
+		if !ok {
+			return
+		}
+		room := rooms[info.Room]
+		if room == nil {
+			return
+		}
+		if err := room.SetSpeed(info.Country, args[1]); err != nil {
+			conn.WriteMessage(websocket.TextMessage, []byte("settings_error "+err.Error()))
+			return
+		}
+		broadcastRoom(info.Room, "speed "+fmt.Sprint(room.Speed.Nanoseconds()/1e6))
+		return
+	}
+	if mt == websocket.TextMessage && len(args) >= 3 && args[0] == "rule" {
+		info, ok := roomConns.Map[conn]
+		if !ok {
+			return
+		}
+		room := rooms[info.Room]
+		if room == nil {
+			return
+		}
+		if err := room.SetRule(info.Country, args[1], args[2] == "on"); err != nil {
+			conn.WriteMessage(websocket.TextMessage, []byte("settings_error "+err.Error()))
+			return
+		}
+		if data, err := json.Marshal(room.Rules); err == nil {
+			broadcastRoom(info.Room, "rules "+string(data))
+		}
+		return
+	}
+	if mt == websocket.TextMessage && len(args) >= 2 && args[0] == "topology" {
+		info, ok := roomConns.Map[conn]
+		if !ok {
+			return
+		}
+		room := rooms[info.Room]
+		if room == nil {
+			return
+		}
+		if err := room.SetTopology(info.Country, args[1]); err != nil {
+			conn.WriteMessage(websocket.TextMessage, []byte("settings_error "+err.Error()))
+			return
+		}
+		broadcastRoom(info.Room, "topology "+room.Topology.Name())
+		return
+	}
+	if mt == websocket.TextMessage && len(args) >= 2 && (args[0] == "size" || args[0] == "aspect") {
+		info, ok := roomConns.Map[conn]
+		if !ok {
+			return
+		}
+		room := rooms[info.Room]
+		if room == nil {
+			return
+		}
+		var err error
+		if args[0] == "size" {
+			err = room.SetSize(info.Country, args[1])
+		} else {
+			err = room.SetAspect(info.Country, args[1])
+		}
+		if err != nil {
+			conn.WriteMessage(websocket.TextMessage, []byte("settings_error "+err.Error()))
+			return
+		}
+		broadcastRoom(info.Room, "size "+room.Size+" "+room.Aspect)
+		return
+	}
+	if mt == websocket.TextMessage && len(args) >= 1 && args[0] == "map" {
+		info, ok := roomConns.Map[conn]
+		if !ok {
+			return
+		}
+		room := rooms[info.Room]
+		if room == nil {
+			return
+		}
+		mapName := ""
+		if len(args) >= 2 {
+			mapName = args[1]
+		}
+		if err := room.SetMap(info.Country, mapName); err != nil {
+			conn.WriteMessage(websocket.TextMessage, []byte("settings_error "+err.Error()))
+			return
+		}
+		broadcastRoom(info.Room, "map "+roomMapName(room))
+		broadcastRoom(info.Room, "topology "+room.Topology.Name())
+		broadcastRoom(info.Room, "player_max "+fmt.Sprint(room.Max))
+		return
+	}
+	if mt == websocket.TextMessage && len(args) >= 2 && args[0] == "chat" {
+		info, ok := roomConns.Map[conn]
+		if !ok {
+			return
+		}
+		text, err := chatText(conn, args[1:])
+		if err == errEmptyChat {
+			return
+		}
+		if err != nil {
+			conn.WriteMessage(websocket.TextMessage, []byte("chat_error "+err.Error()))
+			return
+		}
+		broadcastRoom(info.Room, "chat "+info.Country+" "+text)
 		return
 	}
 }
@@ -135,29 +301,85 @@ func handleRoomCommand(conn *websocket.Conn, mt int, args []string) {
 func roomThread(roomId string, room *Room) {
 	for {
 		time.Sleep(1 * time.Second)
+		if isDraining() {
+			continue
+		}
+		roomConns.Lock()
 		if room.StartTime != nil && time.Now().After(*room.StartTime) {
 			startGame(roomId, room)
 		}
+		roomConns.Unlock()
 	}
 }
 
+// Starts a room's game. It must be called with roomConns locked. The game is
+// made in the background, since placing spawns on a big map takes a while.
 func startGame(roomId string, room *Room) {
-	game := room.Game()
-	// broadcast start
-	gameId := strconv.FormatInt(rand.Int63(), 36)
-	games[gameId] = game
+	if room.Starting {
+		return
+	}
+	room.Starting = true
+	settingsRoom := *room
+	settingsRoom.Countries = make(map[string]bool)
+	for country := range room.Countries {
+		settingsRoom.Countries[country] = true
+	}
 
-	for conn, info := range roomConns.Map {
-		if roomId == info.Room {
-			index := -1
+	go func() {
+		game, err := settingsRoom.Game()
+		var secrets []string
+		if err == nil {
+			secrets, err = newSecrets(len(game.Countries))
+		}
+
+		roomConns.Lock()
+		defer roomConns.Unlock()
+		room.Starting = false
+		if err != nil {
+			// Give the host a chance to pick another map
+			log.Println(err)
+			room.StartTime = new(time.Time)
+			*room.StartTime = time.Now().Add(lobbyCountdown)
+			broadcastRoom(roomId, "settings_error can't start the game: "+err.Error())
+			broadcastRoom(roomId, "time "+fmt.Sprint(room.StartTime.Unix()*1000))
+			return
+		}
+		room.StartTime = nil
+		if !startRunning() {
+			broadcastRoom(roomId, "settings_error the server is shutting down")
+			return
+		}
+
+		// broadcast start
+		gameId := strconv.FormatInt(rand.Int63(), 36)
+		thread := newGameThread(secrets)
+		addGame(gameId, game, thread)
+
+		for conn, info := range roomConns.Map {
+			if roomId == info.Room {
+				index := -1
+				for i, country := range game.Countries {
+					if country == info.Country {
+						index = i
+					}
+				}
+				message := "start " + gameId + " " + fmt.Sprint(index)
+				if index >= 0 {
+					message += " " + secrets[index]
+				}
+				conn.WriteMessage(websocket.TextMessage, []byte(message))
+			}
+		}
+
+		settings := gameSettings{Mode: roomId, Tick: settingsRoom.Speed, Host: -1}
+		if settingsRoom.Custom {
 			for i, country := range game.Countries {
-				if country == info.Country {
-					index = i
+				if country == settingsRoom.Host {
+					settings.Host = i
 				}
 			}
-			conn.WriteMessage(websocket.TextMessage, []byte("start "+gameId+" "+fmt.Sprint(index)))
 		}
-	}
 
-	go startGameThread(gameId, game)
+		go startGameThread(gameId, game, settings, thread)
+	}()
 }